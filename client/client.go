@@ -18,11 +18,12 @@ import (
 )
 
 var (
-	ErrNoHttpAddress   = errors.New("No HTTP address specified")
-	ErrNoDnsAddress    = errors.New("No DNS address specified")
-	ErrInvalidResponse = errors.New("Invalid HTTP response")
-	ErrServiceNotFound = errors.New("Service not found")
-	ErrConflictingUUID = errors.New("Conflicting UUID")
+	ErrNoHttpAddress    = errors.New("No HTTP address specified")
+	ErrNoDnsAddress     = errors.New("No DNS address specified")
+	ErrInvalidResponse  = errors.New("Invalid HTTP response")
+	ErrServiceNotFound  = errors.New("Service not found")
+	ErrConflictingUUID  = errors.New("Conflicting UUID")
+	ErrCallbackNotFound = errors.New("Callback not found")
 )
 
 type (
@@ -265,6 +266,29 @@ func (c *Client) AddCallback(uuid string, cb *msg.Callback) error {
 	}
 }
 
+func (c *Client) RemoveCallback(uuid string) error {
+	req, err := c.newRequest("DELETE", fmt.Sprintf("%s/skydns/callbacks/%s", c.base, uuid), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.h.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.Body != nil {
+		defer resp.Body.Close()
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return ErrCallbackNotFound
+	default:
+		return ErrInvalidResponse
+	}
+}
+
 func (c *Client) joinUrl(uuid string) string {
 	return fmt.Sprintf("%s/skydns/services/%s", c.base, uuid)
 }
@@ -288,7 +312,7 @@ func (c *Client) newRequestDNS(qname string, qtype uint16) (*dns.Msg, error) {
 }
 
 func (c *Client) extractBaseFromLocation(location string) (string, error) {
-	u, err := url.ParseRequestURI(location) 
+	u, err := url.ParseRequestURI(location)
 	if err != nil {
 		return "", err
 	}
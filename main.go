@@ -5,6 +5,7 @@
 package main
 
 import (
+	"encoding/hex"
 	"errors"
 	"flag"
 	"github.com/goraft/raft"
@@ -21,12 +22,36 @@ import (
 var (
 	join, ldns, lhttp, dataDir, domain string
 	rtimeout, wtimeout                 time.Duration
-	discover, norr                     bool
+	discover, norr, versionPriority    bool
+	answerLimit                        int
+	answerSticky                       bool
+	forwardRace                        bool
+	forwardCache                       int
+	stubZones                          string
+	rrl, rrlNXDomains, rrlErrors       int
+	rrlSlip                            int
+	rrlAllow                           string
+	allowRecursion                     string
 	secret                             string
 	nameserver                         string
 	dnssec                             string
+	dnssecGenerate                     string
+	zskLifetime, keyPrepublish         time.Duration
+	signatureCache                     int
+	nsec3                              bool
+	nsec3Salt                          string
+	nsec3Iterations                    uint
+	transfer, transferTSIG             string
+	notify                             string
+	reverse                            string
+	reverseNames                       bool
+	regionNetworks                     string
 	tlskey                             string
 	tlspem                             string
+	dnsTLS, dnsTLSKey, dnsTLSPem       string
+	snapshotInterval                   time.Duration
+	snapshotCount                      uint64
+	loadTimeout                        time.Duration
 )
 
 func init() {
@@ -61,10 +86,41 @@ func init() {
 	flag.DurationVar(&wtimeout, "wtimeout", 2*time.Second, "Write timeout")
 	flag.StringVar(&secret, "secret", "", "Shared secret for use with http api")
 	flag.StringVar(&nameserver, "nameserver", "", "Nameserver address to forward (non-local) queries to e.g. 8.8.8.8:53,8.8.4.4:53")
+	flag.BoolVar(&forwardRace, "forward-race", false, "Forward every query to the two best nameservers at the same time")
+	flag.IntVar(&forwardCache, "forward-cache", 10000, "Number of forwarded replies to cache, 0 disables caching")
+	flag.StringVar(&stubZones, "stub-zones", "", "Domains to forward to their own nameservers, as domain=nameserver;nameserver and comma separated e.g. corp.internal=10.0.0.1:53;10.0.0.2:53,consul=127.0.0.1:8600")
+	flag.StringVar(&allowRecursion, "allow-recursion", "", "Networks that may use SkyDNS as a recursive nameserver e.g. 127.0.0.0/8,10.0.0.0/8, defaults to everyone")
+	flag.IntVar(&rrl, "rrl", 0, "Responses per second to a client network over UDP, 0 disables response rate limiting")
+	flag.IntVar(&rrlNXDomains, "rrl-nxdomains", 0, "NXDOMAIN responses per second to a client network, defaults to -rrl")
+	flag.IntVar(&rrlErrors, "rrl-errors", 0, "Error responses per second to a client network, defaults to -rrl")
+	flag.IntVar(&rrlSlip, "rrl-slip", 2, "Send every n'th rate limited response truncated instead of dropping it, 0 drops all")
+	flag.StringVar(&rrlAllow, "rrl-allow", "", "Networks that are not rate limited e.g. 10.0.0.0/8,192.168.1.0/24")
 	flag.StringVar(&dnssec, "dnssec", "", "Basename of DNSSEC key file e.q. Kskydns.local.+005+38250")
-	flag.BoolVar(&norr, "no-round-robin", false, "Do not round robin A/AAAA replies")
+	flag.StringVar(&dnssecGenerate, "dnssec-generate", "", "Generate and share DNSSEC keys with this algorithm: RSASHA256, ECDSAP256SHA256 or ED25519")
+	flag.DurationVar(&zskLifetime, "zsk-lifetime", 30*24*time.Hour, "Time after which a generated zone signing key is replaced, 0 never replaces it. The key signing key is only replaced by hand")
+	flag.DurationVar(&keyPrepublish, "key-prepublish", 1*time.Hour, "Time a new zone signing key is published before it signs and the old one after it stopped")
+	flag.IntVar(&signatureCache, "signature-cache", 10000, "Number of DNSSEC signatures to cache, 0 disables caching")
+	flag.BoolVar(&nsec3, "nsec3", false, "Use NSEC3 instead of NSEC for DNSSEC denial of existence")
+	flag.StringVar(&nsec3Salt, "nsec3-salt", "", "Hex encoded NSEC3 salt")
+	flag.UintVar(&nsec3Iterations, "nsec3-iterations", 0, "Number of extra NSEC3 hash iterations")
+	flag.StringVar(&transfer, "transfer", "", "Networks allowed to transfer the zone e.g. 10.0.0.0/8,192.168.1.0/24")
+	flag.StringVar(&transferTSIG, "transfer-tsig", "", "TSIG keys that may transfer the zone, as name:base64-secret and comma separated")
+	flag.StringVar(&notify, "notify", "", "Secondaries to send a DNS NOTIFY to when the zone changes e.g. 10.0.0.2:53,10.0.0.3:53")
+	flag.StringVar(&reverse, "reverse", "", "Reverse zones to answer PTR queries for e.g. 10.in-addr.arpa.,168.192.in-addr.arpa.")
+	flag.BoolVar(&reverseNames, "reverse-names", false, "Also return the service names in PTR records")
+	flag.StringVar(&regionNetworks, "region-networks", "", "Regions of the clients, as network:region and comma separated e.g. 10.1.0.0/16:east,10.2.0.0/16:west")
+	flag.BoolVar(&norr, "no-round-robin", false, "Do not round robin A/AAAA replies or shuffle SRV replies by weight")
+	flag.IntVar(&answerLimit, "answer-limit", 0, "Maximum number of SRV, A or AAAA records in a reply, 0 is unlimited. Without -answer-sticky signed replies get the same records for every client")
+	flag.BoolVar(&answerSticky, "answer-sticky", false, "Choose the records in a reply by hashing the client's address, so it keeps getting the same ones")
+	flag.BoolVar(&versionPriority, "version-priority", false, "Give the newest version of a service a better SRV priority")
 	flag.StringVar(&tlskey, "tls-key", "", "TLS Private Key Path")
 	flag.StringVar(&tlspem, "tls-pem", "", "X509 Certificate")
+	flag.StringVar(&dnsTLS, "dns-tls", "", "IP:Port to bind to for DNS-over-TLS e.g. 127.0.0.1:853")
+	flag.StringVar(&dnsTLSKey, "dns-tls-key", "", "TLS Private Key Path for DNS-over-TLS, defaults to -tls-key")
+	flag.StringVar(&dnsTLSPem, "dns-tls-pem", "", "X509 Certificate for DNS-over-TLS, defaults to -tls-pem")
+	flag.DurationVar(&snapshotInterval, "snapshot-interval", 5*time.Minute, "Interval between raft log compactions, 0 disables them")
+	flag.Uint64Var(&snapshotCount, "snapshot-count", 1000, "Minimum number of raft commands applied before a snapshot is taken")
+	flag.DurationVar(&loadTimeout, "load-timeout", 60*time.Second, "Time after which a load report is ignored")
 }
 
 func main() {
@@ -107,7 +163,74 @@ func main() {
 	}
 
 	s := server.NewServer(members, domain, ldns, lhttp, dataDir, rtimeout, wtimeout, secret, nameservers, !norr, tlskey, tlspem)
+	s.SetSnapshot(snapshotInterval, snapshotCount)
+	s.SetVersionPriority(versionPriority)
+	s.SetLoadTimeout(loadTimeout)
+	s.SetForwarding(forwardRace, forwardCache)
+	s.SetAnswerLimit(answerLimit, answerSticky)
 
+	if dnsTLS != "" {
+		if dnsTLSKey == "" {
+			dnsTLSKey = tlskey
+		}
+		if dnsTLSPem == "" {
+			dnsTLSPem = tlspem
+		}
+		if dnsTLSKey == "" || dnsTLSPem == "" {
+			log.Fatal(errors.New("DNS-over-TLS needs a certificate, use -dns-tls-key and -dns-tls-pem or -tls-key and -tls-pem"))
+			return
+		}
+		s.SetTLS(dnsTLS, dnsTLSPem, dnsTLSKey)
+	}
+
+	if allowRecursion != "" {
+		var nets []*net.IPNet
+		for _, n := range strings.Split(allowRecursion, ",") {
+			_, ipnet, err := net.ParseCIDR(n)
+			if err != nil {
+				log.Fatal(err)
+				return
+			}
+			nets = append(nets, ipnet)
+		}
+		s.SetRecursion(nets)
+	}
+
+	if rrl > 0 {
+		var allow []*net.IPNet
+		if rrlAllow != "" {
+			for _, n := range strings.Split(rrlAllow, ",") {
+				_, ipnet, err := net.ParseCIDR(n)
+				if err != nil {
+					log.Fatal(err)
+					return
+				}
+				allow = append(allow, ipnet)
+			}
+		}
+		s.SetRateLimit(rrl, rrlNXDomains, rrlErrors, rrlSlip, allow)
+	}
+
+	if stubZones != "" {
+		zones := make(map[string][]string)
+		for _, z := range strings.Split(stubZones, ",") {
+			i := strings.Index(z, "=")
+			if i < 1 {
+				log.Fatal(errors.New("Stub zone must be given as domain=nameserver;nameserver"))
+				return
+			}
+			zones[z[:i]] = strings.Split(z[i+1:], ";")
+		}
+		if err := s.SetStubZones(zones); err != nil {
+			log.Fatal(err)
+			return
+		}
+	}
+
+	if dnssec != "" && dnssecGenerate != "" {
+		log.Fatal(errors.New("Use either -dnssec or -dnssec-generate"))
+		return
+	}
 	if dnssec != "" {
 		k, p, e := server.ParseKeyFile(dnssec)
 		if e != nil {
@@ -119,6 +242,79 @@ func main() {
 			return
 		}
 		s.SetKeys(k, p)
+		if nsec3 && (k.Algorithm == dns.RSASHA1 || k.Algorithm == dns.DSA) {
+			log.Fatal(errors.New("NSEC3 can not be used with a RSASHA1 or DSA DNSKEY, use e.g. RSASHA1-NSEC3-SHA1 or RSASHA256"))
+			return
+		}
+	}
+	if dnssecGenerate != "" {
+		if e := s.SetKeyManagement(dnssecGenerate, zskLifetime, keyPrepublish); e != nil {
+			log.Fatal(e)
+			return
+		}
+	}
+	s.SetSignatureCache(signatureCache)
+	if nsec3 && (dnssec != "" || dnssecGenerate != "") {
+		if _, e := hex.DecodeString(nsec3Salt); e != nil {
+			log.Fatal(errors.New("NSEC3 salt must be hex encoded"))
+			return
+		}
+		if nsec3Iterations > 2500 {
+			log.Fatal(errors.New("NSEC3 iterations can not be larger than 2500"))
+			return
+		}
+		s.SetNSEC3(nsec3Salt, uint16(nsec3Iterations))
+	}
+
+	if transfer != "" || transferTSIG != "" {
+		var nets []*net.IPNet
+		keys := make(map[string]string)
+		if transfer != "" {
+			for _, n := range strings.Split(transfer, ",") {
+				_, ipnet, err := net.ParseCIDR(n)
+				if err != nil {
+					log.Fatal(err)
+					return
+				}
+				nets = append(nets, ipnet)
+			}
+		}
+		if transferTSIG != "" {
+			for _, k := range strings.Split(transferTSIG, ",") {
+				i := strings.Index(k, ":")
+				if i < 1 {
+					log.Fatal(errors.New("TSIG key must be given as name:secret"))
+					return
+				}
+				keys[dns.Fqdn(strings.ToLower(k[:i]))] = k[i+1:]
+			}
+		}
+		s.SetTransfer(nets, keys)
+	}
+
+	if reverse != "" {
+		s.SetReverse(strings.Split(reverse, ","), reverseNames)
+	}
+
+	if regionNetworks != "" {
+		networks := make(map[string]string)
+		for _, n := range strings.Split(regionNetworks, ",") {
+			// IPv6 networks contain colons as well
+			i := strings.LastIndex(n, ":")
+			if i < 1 {
+				log.Fatal(errors.New("Region network must be given as network:region"))
+				return
+			}
+			networks[n[:i]] = n[i+1:]
+		}
+		if err := s.SetRegionNetworks(networks); err != nil {
+			log.Fatal(err)
+			return
+		}
+	}
+
+	if notify != "" {
+		s.SetNotify(strings.Split(notify, ","))
 	}
 
 	stats.Collect()
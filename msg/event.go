@@ -0,0 +1,23 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package msg
+
+// Event types.
+const (
+	EventAdd       = "add"        // a service was added
+	EventUpdateTTL = "update-ttl" // a service sent a heartbeat
+	EventRemove    = "remove"     // a service was removed through the API
+	EventExpire    = "expire"     // a service was removed because its TTL expired
+	EventHealth    = "health"     // the health of a service changed
+)
+
+// Event describes a change to the registry.
+type Event struct {
+	// Index is the raft index of the command that caused the event, it is
+	// the same on all members of the cluster.
+	Index   uint64
+	Type    string
+	Service Service
+}
@@ -0,0 +1,29 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package msg
+
+import "time"
+
+// Key is a DNSSEC key of the SkyDNS domain. The keys are stored in the
+// registry, so every member of the cluster signs with the same keys.
+type Key struct {
+	DNSKEY    string    // the DNSKEY record in zone file format
+	Private   string    // the private key in the format of dnssec-keygen
+	KSK       bool      // a key signing key signs the DNSKEY RRset, a zone signing key all others
+	Published time.Time // in the DNSKEY RRset from this time
+	Active    time.Time // signs from this time
+	Retired   time.Time // no longer signs from this time, zero when not retired
+	Removed   time.Time // removed from the DNSKEY RRset at this time, zero when not retired
+}
+
+// IsPublished returns true if the key is in the DNSKEY RRset at time t.
+func (k *Key) IsPublished(t time.Time) bool {
+	return !t.Before(k.Published) && (k.Removed.IsZero() || t.Before(k.Removed))
+}
+
+// IsActive returns true if the key signs at time t.
+func (k *Key) IsActive(t time.Time) bool {
+	return !t.Before(k.Active) && (k.Retired.IsZero() || t.Before(k.Retired))
+}
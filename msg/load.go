@@ -0,0 +1,54 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package msg
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrLoadInvalid = errors.New("LoadAverage must not be negative, CPUIdle and MemoryFree must be between 0 and 1")
+
+// Load is a load report of a host, every value is optional.
+type Load struct {
+	LoadAverage *float64  // load average divided by the number of CPUs
+	CPUIdle     *float64  // fraction of CPU time idle, 0 - 1
+	MemoryFree  *float64  // fraction of memory free, 0 - 1
+	Reported    time.Time // set by SkyDNS
+}
+
+// Validate checks the values of the report.
+func (l *Load) Validate() error {
+	if l.LoadAverage != nil && *l.LoadAverage < 0 {
+		return ErrLoadInvalid
+	}
+	for _, f := range []*float64{l.CPUIdle, l.MemoryFree} {
+		if f != nil && (*f < 0 || *f > 1) {
+			return ErrLoadInvalid
+		}
+	}
+	return nil
+}
+
+// Headroom returns how much capacity the host has left, between 0 (none) and 1
+// (idle). It is the headroom of the most constrained resource that is reported,
+// a load average of 1 or more per CPU leaves no headroom. A report without values
+// has a headroom of 1.
+func (l *Load) Headroom() float64 {
+	h := 1.0
+	if l.LoadAverage != nil && 1-*l.LoadAverage < h {
+		h = 1 - *l.LoadAverage
+	}
+	if l.CPUIdle != nil && *l.CPUIdle < h {
+		h = *l.CPUIdle
+	}
+	if l.MemoryFree != nil && *l.MemoryFree < h {
+		h = *l.MemoryFree
+	}
+	if h < 0 {
+		h = 0
+	}
+	return h
+}
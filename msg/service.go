@@ -7,9 +7,11 @@ package msg
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -25,6 +27,43 @@ type Service struct {
 	Expires     time.Time
 	Callback    map[string]Callback `json:"-"` // Callbacks are found by UUID
 	NoExpire    bool                // don't expire the service based on the ttl
+	Metadata    map[string]string   // arbitrary key/value pairs, served as TXT records
+	Check       *Check              // optional health check, performed by the leader
+	Health      *Health             // result of the health check, set by SkyDNS
+}
+
+// Check types.
+const (
+	CheckTCP  = "tcp"  // connect to the service
+	CheckHTTP = "http" // perform a HTTP GET and check the status code
+	CheckDNS  = "dns"  // send a DNS query
+)
+
+// Check describes how the health of a service is checked.
+type Check struct {
+	Type       string // CheckTCP, CheckHTTP or CheckDNS
+	Target     string // host:port to check, defaults to the Host and Port of the service
+	Path       string // path for HTTP checks, defaults to "/"
+	Status     int    // expected HTTP status code, defaults to 200
+	Question   string // name to query for DNS checks, defaults to "."
+	Interval   uint32 // seconds between checks, defaults to 10
+	Timeout    uint32 // seconds, defaults to 5
+	Fall       int    // consecutive failures before the service is unhealthy, defaults to 3
+	Rise       int    // consecutive successes before the service is healthy again, defaults to 2
+	Deregister bool   // remove the service instead of hiding it when it becomes unhealthy
+}
+
+// Health is the state of a service as determined by its health check.
+type Health struct {
+	Healthy bool
+	Output  string    // result of the check that changed the state
+	Since   time.Time // time of the change
+}
+
+// Unhealthy returns true if the health check of the service has failed. Services
+// that are unhealthy are not returned in DNS answers.
+func (s *Service) Unhealthy() bool {
+	return s.Health != nil && !s.Health.Healthy
 }
 
 // RemainingTTL returns the amount of time remaining before expiration.
@@ -38,11 +77,22 @@ func (s *Service) RemainingTTL() uint32 {
 	return ttl
 }
 
+// HasMetadata returns true if the service has metadata key with the value value.
+// An empty value matches any value.
+func (s *Service) HasMetadata(key, value string) bool {
+	v, ok := s.Metadata[key]
+	return ok && (value == "" || v == value)
+}
+
 // UpdateTTL updates the TTL property to the RemainingTTL.
 func (s *Service) UpdateTTL() {
 	s.TTL = s.RemainingTTL()
 }
 
+// callbackClient is used to perform the callbacks, the timeout makes sure a
+// slow endpoint can not hold up the other callbacks.
+var callbackClient = &http.Client{Timeout: 10 * time.Second}
+
 type Callback struct {
 	UUID string
 
@@ -53,24 +103,85 @@ type Callback struct {
 	Region      string
 	Host        string
 
+	// Domain is the domain pattern of the services the callback is for, as
+	// used in DNS queries. When empty it is created from the Name, Version,
+	// Environment and Region.
+	Domain string
+	// Events the callback is called for, when empty it is only called
+	// when a service is removed or has expired.
+	Events []string
+
 	Reply string
 	Port  uint16
 }
 
-// Call calls the callback and performs the HTTP request.
-func (c Callback) Call(s Service) {
-	b, err := json.Marshal(s)
+// callbackMethods holds the HTTP method used for each type of event.
+var callbackMethods = map[string]string{
+	EventAdd:       "PUT",
+	EventUpdateTTL: "PATCH",
+	EventHealth:    "PATCH",
+	EventRemove:    "DELETE",
+	EventExpire:    "DELETE",
+}
+
+// ValidEvent returns true if callbacks can be called for events of type t.
+func ValidEvent(t string) bool {
+	_, ok := callbackMethods[t]
+	return ok
+}
+
+// Pattern returns the domain pattern of the callback.
+func (c *Callback) Pattern() string {
+	if c.Domain != "" {
+		return strings.ToLower(c.Domain)
+	}
+	labels := []string{c.Region, strings.Replace(c.Version, ".", "-", -1), c.Name, c.Environment}
+	for i, l := range labels {
+		if l == "" {
+			labels[i] = "*"
+		}
+	}
+	return strings.ToLower(strings.Join(labels, "."))
+}
+
+// Wants returns true if the callback wants to be called for events of type t.
+func (c *Callback) Wants(t string) bool {
+	if len(c.Events) == 0 {
+		return t == EventRemove || t == EventExpire
+	}
+	for _, e := range c.Events {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Call calls the callback and performs the HTTP request. The body is the
+// service together with the type and raft index of the event.
+func (c Callback) Call(e Event) error {
+	body := struct {
+		Service
+		Event string
+		Index uint64
+	}{e.Service, e.Type, e.Index}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(callbackMethods[e.Type], "http://"+c.Reply+":"+strconv.Itoa(int(c.Port))+"/skydns/callbacks/"+c.UUID, bytes.NewBuffer(b))
 	if err != nil {
-		return
+		return err
 	}
-	req, err := http.NewRequest("DELETE", "http://"+c.Reply+":"+strconv.Itoa(int(c.Port))+"/skydns/callbacks/"+c.UUID, bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := callbackClient.Do(req)
 	if err != nil {
-		log.Println("Failed to create req.", err.Error)
-		return
+		return err
 	}
-	if resp, err := http.DefaultClient.Do(req); err == nil {
-		resp.Body.Close()
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("callback returned HTTP status %d", resp.StatusCode)
 	}
-	log.Println("Performed callback to:", c.Reply, c.Port)
-	return
+	log.Println("Performed callback to:", c.Reply, c.Port, e.Type)
+	return nil
 }
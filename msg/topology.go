@@ -0,0 +1,112 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package msg
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+var ErrTopologyInvalid = errors.New("A region may not prefer itself or list a region twice")
+
+// Topology describes how regions relate to each other, it determines to which
+// regions a request fails over first. For a region either an explicit list of
+// preferred regions, best first, or the distances to other regions can be
+// given; a preference list takes precedence. Distances are symmetric, only one
+// direction has to be given.
+type Topology struct {
+	Preferences map[string][]string          `json:",omitempty"` // preferred regions by region
+	Distances   map[string]map[string]uint32 `json:",omitempty"` // distances between regions
+}
+
+// Validate checks the topology and lowercases all region names.
+func (t *Topology) Validate() error {
+	prefs := make(map[string][]string, len(t.Preferences))
+	for r, list := range t.Preferences {
+		r = strings.ToLower(r)
+		seen := map[string]bool{r: true}
+		l := make([]string, 0, len(list))
+		for _, p := range list {
+			p = strings.ToLower(p)
+			if seen[p] {
+				return ErrTopologyInvalid
+			}
+			seen[p] = true
+			l = append(l, p)
+		}
+		prefs[r] = l
+	}
+	dists := make(map[string]map[string]uint32, len(t.Distances))
+	for r, d := range t.Distances {
+		r = strings.ToLower(r)
+		if dists[r] == nil {
+			dists[r] = make(map[string]uint32, len(d))
+		}
+		for r1, n := range d {
+			dists[r][strings.ToLower(r1)] = n
+		}
+	}
+	t.Preferences, t.Distances = prefs, dists
+	return nil
+}
+
+// distance returns the distance between regions a and b.
+func (t *Topology) distance(a, b string) (uint32, bool) {
+	if n, ok := t.Distances[a][b]; ok {
+		return n, true
+	}
+	n, ok := t.Distances[b][a]
+	return n, ok
+}
+
+// Tiers returns for each region in regions the tier it is in, seen from
+// region: 1 for the nearest (or most preferred) regions, 2 for the next, and
+// so on. Regions without a preference or distance are put in the last tier,
+// after all the known ones. Without any topology for region every region is
+// in tier 1.
+func (t *Topology) Tiers(region string, regions []string) map[string]int {
+	region = strings.ToLower(region)
+	tiers := make(map[string]int, len(regions))
+
+	if prefs, ok := t.Preferences[region]; ok {
+		rank := make(map[string]int, len(prefs))
+		for i, p := range prefs {
+			rank[p] = i + 1
+		}
+		for _, r := range regions {
+			if tier, ok := rank[strings.ToLower(r)]; ok {
+				tiers[r] = tier
+			} else {
+				tiers[r] = len(prefs) + 1
+			}
+		}
+		return tiers
+	}
+
+	// Equal distances share a tier
+	distances := make([]uint32, 0, len(regions))
+	seen := make(map[uint32]bool)
+	for _, r := range regions {
+		if n, ok := t.distance(region, strings.ToLower(r)); ok && !seen[n] {
+			seen[n] = true
+			distances = append(distances, n)
+		}
+	}
+	sort.Sort(uint32Slice(distances))
+	for _, r := range regions {
+		tiers[r] = len(distances) + 1
+		if n, ok := t.distance(region, strings.ToLower(r)); ok {
+			tiers[r] = sort.Search(len(distances), func(i int) bool { return distances[i] >= n }) + 1
+		}
+	}
+	return tiers
+}
+
+type uint32Slice []uint32
+
+func (p uint32Slice) Len() int           { return len(p) }
+func (p uint32Slice) Less(i, j int) bool { return p[i] < p[j] }
+func (p uint32Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
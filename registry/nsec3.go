@@ -0,0 +1,103 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package registry
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// nsec3Hash holds the parameters used to hash names for NSEC3.
+type nsec3Hash struct {
+	zone       string // fully qualified
+	salt       string // hex encoded
+	iterations uint16
+}
+
+// name returns the lowercase NSEC3 hash of key, a name relative to the zone.
+func (h *nsec3Hash) name(key string) string {
+	name := h.zone
+	if key != "" {
+		name = key + "." + h.zone
+	}
+	return strings.ToLower(dns.HashName(name, dns.SHA1, h.iterations, h.salt))
+}
+
+type hashedName struct {
+	hash string
+	name string // name as used in nsec
+}
+
+// NSEC3 enables NSEC3 and hashes all names currently used for denial of existence.
+func (r *DefaultRegistry) NSEC3(zone, salt string, iterations uint16) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.hash = &nsec3Hash{zone: dns.Fqdn(strings.ToLower(zone)), salt: salt, iterations: iterations}
+	r.resetNSEC3()
+	for _, n := range r.nsec {
+		r.addNSEC3(n.name)
+	}
+}
+
+// resetNSEC3 removes all hashed names, except the zone apex, which always exists.
+// The registry lock is already being held.
+func (r *DefaultRegistry) resetNSEC3() {
+	r.nsec3 = nil
+	if r.hash == nil {
+		return
+	}
+	r.nsec3 = make([]hashedName, 0, 10)
+	r.addNSEC3("")
+}
+
+// addNSEC3 adds the hash of key, the registry lock is already being held.
+func (r *DefaultRegistry) addNSEC3(key string) {
+	if r.hash == nil {
+		return
+	}
+	h := r.hash.name(key)
+	i := sort.Search(len(r.nsec3), func(i int) bool { return r.nsec3[i].hash >= h })
+	if i < len(r.nsec3) && r.nsec3[i].hash == h {
+		return
+	}
+	r.nsec3 = append(r.nsec3, hashedName{})
+	copy(r.nsec3[i+1:], r.nsec3[i:])
+	r.nsec3[i] = hashedName{hash: h, name: key}
+}
+
+// removeNSEC3 removes the hash of key, the registry lock is already being held.
+func (r *DefaultRegistry) removeNSEC3(key string) {
+	if r.hash == nil {
+		return
+	}
+	h := r.hash.name(key)
+	i := sort.Search(len(r.nsec3), func(i int) bool { return r.nsec3[i].hash >= h })
+	if i < len(r.nsec3) && r.nsec3[i].hash == h {
+		copy(r.nsec3[i:], r.nsec3[i+1:])
+		r.nsec3 = r.nsec3[:len(r.nsec3)-1]
+	}
+}
+
+// GetNSEC3 returns the hashed name that matches or precedes hash and the hashed
+// name following it. The hashes form a ring: the last hash is followed by the
+// first and precedes every hash smaller than the first.
+func (r *DefaultRegistry) GetNSEC3(hash string) (string, string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.nsec3) == 0 {
+		return "", ""
+	}
+	hash = strings.ToLower(hash)
+	i := sort.Search(len(r.nsec3), func(i int) bool { return r.nsec3[i].hash > hash })
+	// r.nsec3[i-1] matches or precedes hash
+	i--
+	if i < 0 {
+		i = len(r.nsec3) - 1
+	}
+	return r.nsec3[i].hash, r.nsec3[(i+1)%len(r.nsec3)].hash
+}
@@ -5,6 +5,7 @@
 package registry
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/miekg/dns"
@@ -16,45 +17,106 @@ import (
 	"time"
 )
 
+// Load reports this much older than the newest one are removed.
+const loadExpiry = 1 * time.Hour
+
 var (
 	ErrExists    = errors.New("Service already exists in registry")
 	ErrNotExists = errors.New("Service does not exist in registry")
+
+	ErrCallbackNotExists = errors.New("Callback does not exist in registry")
+	ErrStubZoneNotExists = errors.New("Stub zone does not exist in registry")
 )
 
 type Registry interface {
 	Add(s msg.Service) error
 	Get(domain string) ([]msg.Service, error)
 	GetUUID(uuid string) (msg.Service, error)
+	// Lookup retrieves a service based on its UUID, even if it has expired.
+	Lookup(uuid string) (msg.Service, error)
 	GetExpired() []string
 	Remove(s msg.Service) error
 	RemoveUUID(uuid string) error
 	UpdateTTL(uuid string, ttl uint32, expires time.Time) error
 	AddCallback(s msg.Service, c msg.Callback) error
+	// SetCallback adds or replaces a callback for the services matching its domain pattern.
+	SetCallback(c msg.Callback)
+	RemoveCallback(uuid string) error
+	// GetCallbacks returns the callbacks for service s, both the ones added to
+	// the service and the ones whose domain pattern matches it.
+	GetCallbacks(s msg.Service) []msg.Callback
+	SetHealth(uuid string, h msg.Health) error
 	Len() int
 	// GetNSEC return the previous and next name according to the key given.
 	GetNSEC(key string) (string, string)
+	// NSEC3 enables NSEC3, the names used for denial of existence are also kept
+	// hashed as names in zone, with the given salt and iterations.
+	NSEC3(zone, salt string, iterations uint16)
+	// GetNSEC3 returns the hashed name that matches or precedes hash, and the
+	// hashed name following it.
+	GetNSEC3(hash string) (string, string)
 	// DNSSEC sets or resets if we support DNSSEC.
 	DNSSEC(bool) bool
+	// SetLoad stores the load report of host, reports that are more than
+	// loadExpiry older than it are removed.
+	SetLoad(host string, l msg.Load)
+	// Loads returns the load reports by host.
+	Loads() map[string]msg.Load
+	// SetTopology replaces the region topology.
+	SetTopology(t msg.Topology)
+	// Topology returns the region topology.
+	Topology() msg.Topology
+	// SetStubZone forwards the queries for domain to nameservers.
+	SetStubZone(domain string, nameservers []string)
+	RemoveStubZone(domain string) error
+	// StubZones returns the nameservers by domain.
+	StubZones() map[string][]string
+	// SetKeys replaces the DNSSEC keys of the domain.
+	SetKeys(keys []msg.Key)
+	// Keys returns the DNSSEC keys of the domain.
+	Keys() []msg.Key
+	// Index returns the raft index of the last change to the registry.
+	Index() uint64
+	// SetIndex records the raft index of a change to the registry.
+	SetIndex(index uint64)
+	// Save returns a snapshot of the registry, it implements raft.StateMachine.
+	Save() ([]byte, error)
+	// Recovery replaces the contents of the registry with a snapshot
+	// created by Save, it implements raft.StateMachine.
+	Recovery([]byte) error
 }
 
 // New returns a new DefaultRegistry.
 func New() Registry {
 	return &DefaultRegistry{
-		tree:  newNode(),
-		nodes: make(map[string]*node),
-		nsec:  make([]denialReference, 0, 10),
+		tree:      newNode(),
+		nodes:     make(map[string]*node),
+		callbacks: make(map[string]msg.Callback),
+		loads:     make(map[string]msg.Load),
+		stubZones: make(map[string][]string),
+		nsec:      make([]denialReference, 0, 10),
 	}
 }
 
 // DefaultRegistry is a datastore for registered services.
 type DefaultRegistry struct {
-	tree  *node
-	nodes map[string]*node
-	mutex sync.Mutex
+	tree      *node
+	nodes     map[string]*node
+	callbacks map[string]msg.Callback // callbacks for a domain pattern, by UUID
+	loads     map[string]msg.Load     // load reports by host
+	topology  msg.Topology            // how regions relate to each other
+	stubZones map[string][]string     // nameservers by domain
+	keys      []msg.Key               // DNSSEC keys of the domain
+	index     uint64                  // raft index of the last change
+	mutex     sync.Mutex
 
 	// holds a list of sorted domain names
 	nsec   []denialReference // D N S S E C
 	dnssec bool              // if dnssec is disabled, some expensive data structures aren't used
+
+	// holds the names of nsec hashed and sorted on the hash, only used with NSEC3
+	nsec3 []hashedName
+	hash  *nsec3Hash // nil when NSEC3 is not used
 }
 
 type denialReference struct {
@@ -62,11 +124,33 @@ type denialReference struct {
 	reference int    // reference count
 }
 
+// snapshot is the serialized form of the registry. Only the services and the
+// callbacks are stored, the tree, the nodes map and the NSEC references are
+// rebuilt from them when the snapshot is recovered.
+type snapshot struct {
+	Services  []snapshotService
+	Callbacks []msg.Callback
+	Loads     map[string]msg.Load
+	Topology  msg.Topology
+	StubZones map[string][]string
+	Keys      []msg.Key
+	Index     uint64
+}
+
+type snapshotService struct {
+	Service  msg.Service
+	Callback map[string]msg.Callback // msg.Service does not serialize its callbacks
+}
+
 // Add adds a service to registry.
 func (r *DefaultRegistry) Add(s msg.Service) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
+	return r.add(s)
+}
 
+// add adds a service to the registry while r.mutex is held.
+func (r *DefaultRegistry) add(s msg.Service) error {
 	// TODO: Validate service has correct values, and getRegistryKey returns a valid value
 	if _, ok := r.nodes[s.UUID]; ok {
 		return ErrExists
@@ -77,10 +161,9 @@ func (r *DefaultRegistry) Add(s msg.Service) error {
 	if err == nil {
 		r.nodes[n.value.UUID] = n
 		if r.dnssec {
-			r.addNSEC(s.Region + "." + s.Version + "." + s.Name + "." + s.Environment)
-			r.addNSEC(s.Version + "." + s.Name + "." + s.Environment)
-			r.addNSEC(s.Name + "." + s.Environment)
-			r.addNSEC(s.Environment)
+			for _, key := range nsecKeys(k) {
+				r.addNSEC(key)
+			}
 		}
 	}
 	return err
@@ -98,6 +181,7 @@ func (r *DefaultRegistry) addNSEC(key string) {
 
 	r.nsec[i].name = key
 	r.nsec[i].reference = 1
+	r.addNSEC3(key)
 }
 
 // RemoveUUID removes a Service specified by an UUID.
@@ -131,19 +215,15 @@ func (r *DefaultRegistry) removeService(s msg.Service) error {
 	// because this means, we just removed a bad service entry.
 	// Map deletion is also a no-op, if entry not found in map
 	delete(r.nodes, s.UUID)
-	// No matter what, call the callbacks
-	log.Println("Calling", len(s.Callback), "callback(s) for service", s.UUID)
-	for _, c := range s.Callback {
-		c.Call(s)
-	}
+	// Callbacks are not called here, the server delivers them asynchronously
+	// so the registry lock is never held while doing network I/O.
 
 	// TODO: Validate service has correct values, and getRegistryKey returns a valid value
 	k := getRegistryKey(s)
 	if r.dnssec {
-		r.removeNSEC(s.Region + "." + s.Version + "." + s.Name + "." + s.Environment)
-		r.removeNSEC(s.Version + "." + s.Name + "." + s.Environment)
-		r.removeNSEC(s.Name + "." + s.Environment)
-		r.removeNSEC(s.Environment)
+		for _, key := range nsecKeys(k) {
+			r.removeNSEC(key)
+		}
 	}
 
 	return r.tree.remove(strings.Split(k, "."))
@@ -155,6 +235,7 @@ func (r *DefaultRegistry) removeNSEC(key string) {
 	if i < len(r.nsec) && r.nsec[i].name == key {
 		r.nsec[i].reference--
 		if r.nsec[i].reference == 0 {
+			r.removeNSEC3(key)
 			copy(r.nsec[i:], r.nsec[i+1:])
 			r.nsec[len(r.nsec)-1] = denialReference{"", 0}
 			r.nsec = r.nsec[:len(r.nsec)-1]
@@ -188,6 +269,18 @@ func (r *DefaultRegistry) GetUUID(uuid string) (s msg.Service, err error) {
 	return s, ErrNotExists
 }
 
+// Lookup retrieves a service based on its UUID. Unlike GetUUID it also
+// returns services whose TTL has run out, but have not been removed yet.
+func (r *DefaultRegistry) Lookup(uuid string) (msg.Service, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if n, ok := r.nodes[uuid]; ok {
+		return n.value, nil
+	}
+	return msg.Service{}, ErrNotExists
+}
+
 func (r *DefaultRegistry) GetNSEC(key string) (string, string) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
@@ -220,11 +313,39 @@ func (r *DefaultRegistry) DNSSEC(b bool) bool {
 // any of these positions may supply the wildcard "*", to have all values match in this position.
 // additionally, you only need to specify as much of the domain as needed the domain version.service.environment is perfectly acceptable,
 // and will assume "*" for all the ommited subdomain positions
+// The version may also be a semantic version pattern, see parseVersionPattern.
 func (r *DefaultRegistry) Get(domain string) ([]msg.Service, error) {
-	// TODO: account for version wildcards
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
+	return r.tree.get(splitDomain(domain))
+}
+
+// Match returns true if the service s matches the domain pattern, i.e. when
+// it would be returned by Get(domain).
+func Match(domain string, s msg.Service) bool {
+	tree := splitDomain(domain)
+	key := strings.Split(getRegistryKey(s), ".")
+	if len(key) != len(tree) {
+		return false
+	}
+	for i, k := range tree {
+		switch {
+		case k == "*" || k == key[i]:
+			continue
+		case len(tree)-i == versionDepth:
+			if p := parseVersionPattern(k); p != nil && p.match(ParseVersion(s.Version)) {
+				continue
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// splitDomain splits a domain pattern into its labels, padded with wildcards
+// for the positions that are not given.
+func splitDomain(domain string) []string {
 	// Ensure we are using lowercase keys, as this is the way they are stored
 	domain = strings.ToLower(domain)
 
@@ -246,7 +367,7 @@ func (r *DefaultRegistry) Get(domain string) ([]msg.Service, error) {
 
 		tree = append(t, tree...)
 	}
-	return r.tree.get(tree)
+	return tree
 }
 
 // GetExpired returns a slice of expired UUIDs.
@@ -282,6 +403,213 @@ func (r *DefaultRegistry) AddCallback(s msg.Service, c msg.Callback) error {
 	return ErrNotExists
 }
 
+// SetCallback adds callback c, which is called for all services matching its
+// domain pattern, including the ones that are added later.
+func (r *DefaultRegistry) SetCallback(c msg.Callback) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.callbacks[c.UUID] = c
+}
+
+// RemoveCallback removes the callback with UUID uuid that was added with SetCallback.
+func (r *DefaultRegistry) RemoveCallback(uuid string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.callbacks[uuid]; !ok {
+		return ErrCallbackNotExists
+	}
+	delete(r.callbacks, uuid)
+	return nil
+}
+
+// GetCallbacks returns the callbacks of service s and the callbacks whose
+// domain pattern matches s.
+func (r *DefaultRegistry) GetCallbacks(s msg.Service) []msg.Callback {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	callbacks := make([]msg.Callback, 0, len(s.Callback))
+	for _, c := range s.Callback {
+		callbacks = append(callbacks, c)
+	}
+	for _, c := range r.callbacks {
+		if Match(c.Pattern(), s) {
+			callbacks = append(callbacks, c)
+		}
+	}
+	return callbacks
+}
+
+// SetLoad stores load report l of host. Reports that are more than loadExpiry
+// older than l are removed, so hosts that are gone do not stay around forever.
+func (r *DefaultRegistry) SetLoad(host string, l msg.Load) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.loads[strings.ToLower(host)] = l
+	for h, l1 := range r.loads {
+		if l.Reported.Sub(l1.Reported) > loadExpiry {
+			delete(r.loads, h)
+		}
+	}
+}
+
+// Loads returns a copy of the load reports by host.
+func (r *DefaultRegistry) Loads() map[string]msg.Load {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	loads := make(map[string]msg.Load, len(r.loads))
+	for h, l := range r.loads {
+		loads[h] = l
+	}
+	return loads
+}
+
+// SetTopology replaces the region topology with t.
+func (r *DefaultRegistry) SetTopology(t msg.Topology) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.topology = t
+}
+
+// Topology returns the region topology.
+func (r *DefaultRegistry) Topology() msg.Topology {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.topology
+}
+
+// SetStubZone adds or replaces the nameservers for domain.
+func (r *DefaultRegistry) SetStubZone(domain string, nameservers []string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.stubZones[dns.Fqdn(strings.ToLower(domain))] = nameservers
+}
+
+// RemoveStubZone removes the nameservers for domain.
+func (r *DefaultRegistry) RemoveStubZone(domain string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	domain = dns.Fqdn(strings.ToLower(domain))
+	if _, ok := r.stubZones[domain]; !ok {
+		return ErrStubZoneNotExists
+	}
+	delete(r.stubZones, domain)
+	return nil
+}
+
+// StubZones returns a copy of the nameservers by domain.
+func (r *DefaultRegistry) StubZones() map[string][]string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	zones := make(map[string][]string, len(r.stubZones))
+	for d, ns := range r.stubZones {
+		zones[d] = ns
+	}
+	return zones
+}
+
+// SetKeys replaces the DNSSEC keys with keys.
+func (r *DefaultRegistry) SetKeys(keys []msg.Key) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.keys = keys
+}
+
+// Keys returns a copy of the DNSSEC keys.
+func (r *DefaultRegistry) Keys() []msg.Key {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]msg.Key(nil), r.keys...)
+}
+
+// Index returns the raft index of the last change to the registry.
+func (r *DefaultRegistry) Index() uint64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.index
+}
+
+// SetIndex records index as the raft index of the last change to the registry.
+func (r *DefaultRegistry) SetIndex(index uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if index > r.index {
+		r.index = index
+	}
+}
+
+// SetHealth sets the health of the service with UUID uuid.
+func (r *DefaultRegistry) SetHealth(uuid string, h msg.Health) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if n, ok := r.nodes[uuid]; ok {
+		n.value.Health = &h
+		return nil
+	}
+	return ErrNotExists
+}
+
+// Save returns a JSON encoded snapshot of all services and callbacks in the registry.
+func (r *DefaultRegistry) Save() ([]byte, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	snap := snapshot{Services: make([]snapshotService, 0, len(r.nodes)), Callbacks: make([]msg.Callback, 0, len(r.callbacks)), Loads: r.loads, Topology: r.topology, StubZones: r.stubZones, Keys: r.keys, Index: r.index}
+	for _, n := range r.nodes {
+		snap.Services = append(snap.Services, snapshotService{Service: n.value, Callback: n.value.Callback})
+	}
+	for _, c := range r.callbacks {
+		snap.Callbacks = append(snap.Callbacks, c)
+	}
+	return json.Marshal(snap)
+}
+
+// Recovery throws away the current contents of the registry and loads the
+// services from a snapshot created by Save.
+func (r *DefaultRegistry) Recovery(b []byte) error {
+	var snap snapshot
+	if err := json.Unmarshal(b, &snap); err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.tree = newNode()
+	r.nodes = make(map[string]*node)
+	r.callbacks = make(map[string]msg.Callback)
+	r.loads = make(map[string]msg.Load)
+	for h, l := range snap.Loads {
+		r.loads[h] = l
+	}
+	r.topology = snap.Topology
+	r.stubZones = make(map[string][]string)
+	for d, ns := range snap.StubZones {
+		r.stubZones[d] = ns
+	}
+	r.keys = snap.Keys
+	r.index = snap.Index
+	r.nsec = make([]denialReference, 0, 10)
+	r.resetNSEC3()
+	for _, c := range snap.Callbacks {
+		r.callbacks[c.UUID] = c
+	}
+	for _, s := range snap.Services {
+		s.Service.Callback = s.Callback
+		if err := r.add(s.Service); err != nil {
+			return err
+		}
+	}
+	log.Println("Recovered", len(snap.Services), "service(s) from snapshot")
+	return nil
+}
+
 // Len returns the size of the registry r.
 func (r *DefaultRegistry) Len() int {
 	return r.tree.size()
@@ -292,7 +620,8 @@ type node struct {
 	depth  int
 	length int
 
-	value msg.Service
+	version Version // parsed version, only set on nodes at versionDepth
+	value   msg.Service
 }
 
 func newNode() *node {
@@ -357,6 +686,9 @@ func (n *node) add(tree []string, s msg.Service) (*node, error) {
 	if _, ok := n.leaves[k]; !ok {
 		n.leaves[k] = newNode()
 		n.leaves[k].depth = n.depth + 1
+		if n.leaves[k].depth == versionDepth {
+			n.leaves[k].version = ParseVersion(s.Version)
+		}
 	}
 
 	newNode, err := n.leaves[k].add(tree[:len(tree)-1], s)
@@ -406,6 +738,12 @@ func (n *node) get(tree []string) (services []msg.Service, err error) {
 
 	k := tree[len(tree)-1]
 
+	if k != "*" && n.depth+1 == versionDepth {
+		if p := parseVersionPattern(k); p != nil {
+			return n.getVersion(k, p, tree[:len(tree)-1])
+		}
+	}
+
 	switch k {
 	case "*":
 		if len(n.leaves) == 0 {
@@ -433,6 +771,37 @@ func (n *node) get(tree []string) (services []msg.Service, err error) {
 	return
 }
 
+// getVersion gets the services from all version leaves that match the version
+// pattern p, or that are literally named k.
+func (n *node) getVersion(k string, p versionPattern, tree []string) (services []msg.Service, err error) {
+	var success bool
+	for v, l := range n.leaves {
+		if v != k && !p.match(l.version) {
+			continue
+		}
+		if s, e := l.get(tree); e == nil {
+			services = append(services, s...)
+			success = true
+		}
+	}
+
+	if !success {
+		return services, ErrNotExists
+	}
+	return
+}
+
 func getRegistryKey(s msg.Service) string {
 	return strings.ToLower(fmt.Sprintf("%s.%s.%s.%s.%s.%s", s.UUID, strings.Replace(s.Host, ".", "-", -1), s.Region, strings.Replace(s.Version, ".", "-", -1), s.Name, s.Environment))
 }
+
+// nsecKeys returns the names used for denial of existence for registry key k:
+// region.version.name.environment and all names above it.
+func nsecKeys(k string) []string {
+	labels := strings.Split(k, ".")
+	keys := make([]string, 0, 4)
+	for i := 2; i < len(labels); i++ {
+		keys = append(keys, strings.Join(labels[i:], "."))
+	}
+	return keys
+}
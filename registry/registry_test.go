@@ -308,3 +308,249 @@ func TestGetExpired(t *testing.T) {
 func getExpirationTime(ttl uint32) time.Time {
 	return time.Now().Add(time.Duration(ttl) * time.Second)
 }
+
+func TestSaveRecovery(t *testing.T) {
+	reg := New()
+
+	for _, s := range services {
+		if err := reg.Add(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := msg.Callback{UUID: "cb1", Reply: "localhost", Port: 5441}
+	if err := reg.AddCallback(services[0], c); err != nil {
+		t.Fatal(err)
+	}
+	reg.SetCallback(msg.Callback{UUID: "cb2", Domain: "testservice.production", Reply: "localhost", Port: 5441})
+	reg.SetIndex(42)
+	reg.SetTopology(msg.Topology{Preferences: map[string][]string{"east": {"central", "west"}}})
+	reg.SetStubZone("Corp.Internal", []string{"10.0.0.1:53"})
+	reg.SetKeys([]msg.Key{{DNSKEY: "skydns.local. 60 IN DNSKEY 257 3 13 AAAA", KSK: true}})
+
+	b, err := reg.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg1 := New()
+	reg1.DNSSEC(true)
+	reg1.Add(msg.Service{UUID: "999", Name: "Other", Version: "1", Region: "Test", Host: "localhost", Environment: "Production", Port: 80})
+
+	if err := reg1.Recovery(b); err != nil {
+		t.Fatal(err)
+	}
+
+	if reg1.Len() != 2 {
+		t.Fatal("Registry length incorrect after recovery", reg1.Len())
+	}
+	if _, err := reg1.GetUUID("999"); err != ErrNotExists {
+		t.Fatal("Recovery should replace the contents of the registry")
+	}
+
+	r1 := reg1.(*DefaultRegistry)
+	n, ok := r1.nodes[services[0].UUID]
+	if !ok {
+		t.Fatal("Service not recovered")
+	}
+	if _, ok := n.value.Callback["cb1"]; !ok {
+		t.Fatal("Callback not recovered")
+	}
+	if _, ok := r1.callbacks["cb2"]; !ok {
+		t.Fatal("Pattern callback not recovered")
+	}
+	if reg1.Index() != 42 {
+		t.Fatal("Index not recovered")
+	}
+	if prefs := reg1.Topology().Preferences["east"]; len(prefs) != 2 || prefs[0] != "central" {
+		t.Fatal("Topology not recovered", prefs)
+	}
+	if ns := reg1.StubZones()["corp.internal."]; len(ns) != 1 {
+		t.Fatal("Stub zones not recovered")
+	}
+	if keys := reg1.Keys(); len(keys) != 1 || !keys[0].KSK {
+		t.Fatal("Keys not recovered", keys)
+	}
+	if len(r1.nsec) != 6 {
+		t.Fatal("NSEC references not rebuilt", len(r1.nsec))
+	}
+
+	// Services must still be found through the tree
+	results, err := reg1.Get("testservice.production")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatal("Failed to return correct services")
+	}
+}
+
+func TestGetCallbacks(t *testing.T) {
+	reg := New()
+
+	// Callbacks can be added before any service exists
+	reg.SetCallback(msg.Callback{UUID: "cb1", Name: "TestService", Environment: "Production"})
+	reg.SetCallback(msg.Callback{UUID: "cb2", Domain: "1-0-1.testservice.production"})
+	reg.SetCallback(msg.Callback{UUID: "cb3", Domain: "otherservice.production"})
+
+	for _, s := range services {
+		if err := reg.Add(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reg.AddCallback(services[0], msg.Callback{UUID: "cb4"})
+
+	serv, _ := reg.Lookup(services[0].UUID)
+	if c := reg.GetCallbacks(serv); len(c) != 2 {
+		t.Fatalf("Service %s should have 2 callbacks, got %d", serv.UUID, len(c))
+	}
+	serv, _ = reg.Lookup(services[1].UUID)
+	if c := reg.GetCallbacks(serv); len(c) != 2 {
+		t.Fatalf("Service %s should have 2 callbacks, got %d", serv.UUID, len(c))
+	}
+
+	if err := reg.RemoveCallback("cb1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.RemoveCallback("cb1"); err != ErrCallbackNotExists {
+		t.Fatal("Removing a removed callback should fail")
+	}
+	if c := reg.GetCallbacks(serv); len(c) != 1 {
+		t.Fatalf("Service %s should have 1 callback, got %d", serv.UUID, len(c))
+	}
+}
+
+func TestNSEC3(t *testing.T) {
+	reg := New()
+	reg.DNSSEC(true)
+	for _, s := range services {
+		if err := reg.Add(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reg.NSEC3("skydns.local", "aabb", 5)
+
+	r := reg.(*DefaultRegistry)
+	// the apex and the 6 names of the services
+	if len(r.nsec3) != 7 {
+		t.Fatal("Hashed names not created", len(r.nsec3))
+	}
+	for i := 1; i < len(r.nsec3); i++ {
+		if r.nsec3[i-1].hash >= r.nsec3[i].hash {
+			t.Fatal("Hashed names not sorted")
+		}
+	}
+
+	h := r.hash.name("testservice.production")
+	if prev, next := reg.GetNSEC3(h); prev != h || next == h {
+		t.Fatal("Hashed name of testservice.production not found")
+	}
+	// Hashes before the first one are covered by the last one
+	first, last := r.nsec3[0].hash, r.nsec3[len(r.nsec3)-1].hash
+	if prev, next := reg.GetNSEC3("0"); prev != last || next != first {
+		t.Fatal("Hashes should wrap around")
+	}
+
+	reg.Remove(services[0])
+	if len(r.nsec3) != 5 {
+		t.Fatal("Hashed names not removed", len(r.nsec3))
+	}
+}
+
+func TestSetLoad(t *testing.T) {
+	reg := New()
+	idle := 0.9
+	now := time.Now()
+
+	reg.SetLoad("Web1", msg.Load{CPUIdle: &idle, Reported: now.Add(-80 * time.Minute)})
+	reg.SetLoad("web2", msg.Load{CPUIdle: &idle, Reported: now.Add(-30 * time.Minute)})
+	if len(reg.Loads()) != 2 {
+		t.Fatal("Load reports not stored")
+	}
+	reg.SetLoad("web3", msg.Load{CPUIdle: &idle, Reported: now})
+	loads := reg.Loads()
+	if _, ok := loads["web1"]; ok {
+		t.Fatal("Expired load report not removed")
+	}
+	if _, ok := loads["web2"]; !ok || len(loads) != 2 {
+		t.Fatal("Load reports removed that have not expired")
+	}
+}
+
+func TestGetVersion(t *testing.T) {
+	reg := New()
+
+	for _, s := range services {
+		if err := reg.Add(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reg.Add(msg.Service{UUID: "456", Name: "TestService", Version: "1.2.0", Region: "Test", Host: "localhost", Environment: "Production", Port: 9002})
+	reg.Add(msg.Service{UUID: "789", Name: "TestService", Version: "beta", Region: "Test", Host: "localhost", Environment: "Production", Port: 9003})
+
+	tests := []struct {
+		query string
+		count int
+	}{
+		{"1.testservice.production", 3},
+		{"1-x.testservice.production", 3},
+		{"1-0.testservice.production", 2},
+		{"1-x-1.testservice.production", 1},
+		{"1-0-1.testservice.production", 1},
+		{"1-2.testservice.production", 1},
+		{"beta.testservice.production", 1},
+		{"*.testservice.production", 4},
+		{"2.testservice.production", 0},
+		{"1-3.testservice.production", 0},
+	}
+	for _, tc := range tests {
+		results, err := reg.Get(tc.query)
+		if tc.count == 0 {
+			if err != ErrNotExists {
+				t.Errorf("Query %q should not return services", tc.query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Query %q failed: %s", tc.query, err)
+			continue
+		}
+		if len(results) != tc.count {
+			t.Errorf("Query %q returned %d services, %d expected", tc.query, len(results), tc.count)
+		}
+	}
+}
+
+func TestVersionLess(t *testing.T) {
+	if !ParseVersion("1.0.1").Less(ParseVersion("1.2")) {
+		t.Fatal("1.0.1 should be older than 1.2")
+	}
+	if ParseVersion("1.2").Less(ParseVersion("1.2.0")) || ParseVersion("1.2.0").Less(ParseVersion("1.2")) {
+		t.Fatal("1.2 and 1.2.0 should be equal")
+	}
+	if ParseVersion("1.0.0-rc1") != nil {
+		t.Fatal("1.0.0-rc1 is not a semantic version")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		domain string
+		match  bool
+	}{
+		{"*", true},
+		{"production", true},
+		{"testservice.production.", true},
+		{"1-0.TestService.production", true},
+		{"1-0-0.testservice.production", true},
+		{"test.*.testservice.production", true},
+		{"123.localhost.test.1-0-0.testservice.production", true},
+		{"1-1.testservice.production", false},
+		{"east.*.testservice.production", false},
+		{"testing", false},
+	}
+	for _, tc := range tests {
+		if Match(tc.domain, services[0]) != tc.match {
+			t.Errorf("Match of %q should be %t", tc.domain, tc.match)
+		}
+	}
+}
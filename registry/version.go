@@ -0,0 +1,94 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package registry
+
+import (
+	"strconv"
+	"strings"
+)
+
+// versionDepth is the depth of the version nodes in the registry tree:
+// environment (1), name (2), version (3), region (4), host (5), uuid (6).
+const versionDepth = 3
+
+// Version is a parsed semantic version, i.e. 1.2.3 is Version{1, 2, 3}.
+type Version []int
+
+// ParseVersion parses a version in the form 1.2.3, as used in msg.Service, or
+// 1-2-3, as used in domain names. It returns nil if v is not a semantic version.
+func ParseVersion(v string) Version {
+	parts := strings.Split(strings.Replace(v, ".", "-", -1), "-")
+	version := make(Version, len(parts))
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil
+		}
+		version[i] = n
+	}
+	return version
+}
+
+// Less returns true if version v is older than w. Missing components are
+// counted as zero, so 1.2 equals 1.2.0.
+func (v Version) Less(w Version) bool {
+	for i := 0; i < len(v) || i < len(w); i++ {
+		a, b := v.component(i), w.component(i)
+		if a != b {
+			return a < b
+		}
+	}
+	return false
+}
+
+func (v Version) component(i int) int {
+	if i < len(v) {
+		return v[i]
+	}
+	return 0
+}
+
+// versionPattern matches semantic versions, a component of -1 matches anything.
+type versionPattern []int
+
+// parseVersionPattern parses the version label of a query. The components are
+// separated by a "-" and may be "x" or "*" to match any value. Components
+// that are not given match anything, so:
+//
+// 1 matches any 1.x.x
+// 1-2 matches any 1.2.x
+// 1-x-3 matches 1.0.3, 1.1.3, etc.
+// 1-2-3 matches 1.2.3
+//
+// It returns nil if the label is not a version pattern.
+func parseVersionPattern(label string) versionPattern {
+	parts := strings.Split(label, "-")
+	pattern := make(versionPattern, len(parts))
+	for i, p := range parts {
+		if p == "x" || p == "*" {
+			pattern[i] = -1
+			continue
+		}
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil
+		}
+		pattern[i] = n
+	}
+	return pattern
+}
+
+// match returns true when version v matches the pattern.
+func (p versionPattern) match(v Version) bool {
+	if v == nil {
+		return false
+	}
+	for i, c := range p {
+		if c != -1 && c != v.component(i) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// SetAnswerLimit limits the number of SRV, A and AAAA records in a reply to
+// limit, 0 does not limit them. The records with the best priority (for A and
+// AAAA records: the nearest region) are kept, within a priority SRV records
+// are chosen by their weights. With sticky the records are chosen by hashing
+// the address of the client instead of at random, so a client keeps getting
+// the same records as long as the services do not change. Every subset of the
+// records is an RRset of its own that has to be signed, so without sticky
+// signed replies get the same records for every client, in a random order.
+func (s *Server) SetAnswerLimit(limit int, sticky bool) {
+	s.answerLimit = limit
+	s.sticky = sticky
+}
+
+// everyone is the client address that chooses the records when every client
+// must get the same ones.
+var everyone = net.IPv6unspecified
+
+// weightedRecord is a record with its sort key for orderRecords.
+type weightedRecord struct {
+	rr  dns.RR
+	key float64
+	u   float64
+}
+
+type byKey []weightedRecord
+
+func (p byKey) Len() int { return len(p) }
+func (p byKey) Less(i, j int) bool {
+	if p[i].key != p[j].key {
+		return p[i].key < p[j].key
+	}
+	return p[i].u < p[j].u
+}
+func (p byKey) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+// orderRecords orders records at random, records with a higher weight are more
+// likely to come first (weighted random sampling without replacement, by
+// Efraimidis and Spirakis). Records with weight 0 come last. With a client the
+// random numbers are a hash of the client and the record, which gives every
+// client its own, stable, order: weighted rendezvous hashing.
+func orderRecords(records []dns.RR, weight func(dns.RR) uint16, client net.IP) {
+	if len(records) < 2 {
+		return
+	}
+	wr := make(byKey, len(records))
+	for i, r := range records {
+		var u float64
+		if client != nil {
+			u = clientHash(client, r)
+		} else {
+			u = 1 - rand.Float64() // in (0, 1]
+		}
+		key := math.Inf(1)
+		if w := weight(r); w > 0 {
+			key = -math.Log(u) / float64(w)
+		}
+		wr[i] = weightedRecord{r, key, u}
+	}
+	sort.Sort(wr)
+	for i := range wr {
+		records[i] = wr[i].rr
+	}
+}
+
+// clientHash returns a number in (0, 1] that only depends on client and the
+// data of record r, not on its TTL.
+func clientHash(client net.IP, r dns.RR) float64 {
+	h := fnv.New64a()
+	h.Write(client.To16())
+	h.Write([]byte(strings.TrimPrefix(r.String(), r.Header().String())))
+	return float64(h.Sum64()>>11+1) / (1 << 53)
+}
+
+func unitWeight(dns.RR) uint16  { return 1 }
+func srvWeight(r dns.RR) uint16 { return r.(*dns.SRV).Weight }
+
+// shuffle orders the records of one priority, for the client at address
+// client. Of these records keep fit in a limited answer. For everyone these are
+// the same records, but in a random order with round robin, the order does not
+// change the signature. Without round robin or stickiness the order is not
+// changed.
+func (s *Server) shuffle(records []dns.RR, weight func(dns.RR) uint16, client net.IP, keep int) {
+	switch {
+	case client != nil && client.Equal(everyone):
+		orderRecords(records, weight, client)
+		if !s.roundrobin {
+			return
+		}
+		if s.answerLimit <= 0 || keep > len(records) {
+			keep = len(records)
+		}
+		if keep > 0 {
+			orderRecords(records[:keep], weight, nil)
+		}
+	case client != nil && s.sticky:
+		orderRecords(records, weight, client)
+	case s.roundrobin:
+		orderRecords(records, weight, nil)
+	}
+}
+
+// orderSRV sorts the SRV records on priority and shuffles the records with the
+// same priority by their weights.
+func (s *Server) orderSRV(records []dns.RR, client net.IP) {
+	sort.Stable(byPriority(records))
+	for i := 0; i < len(records); {
+		j := i + 1
+		for j < len(records) && records[j].(*dns.SRV).Priority == records[i].(*dns.SRV).Priority {
+			j++
+		}
+		s.shuffle(records[i:j], srvWeight, client, s.answerLimit-i)
+		i = j
+	}
+}
+
+type byPriority []dns.RR
+
+func (p byPriority) Len() int           { return len(p) }
+func (p byPriority) Less(i, j int) bool { return p[i].(*dns.SRV).Priority < p[j].(*dns.SRV).Priority }
+func (p byPriority) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// limitAnswer returns the records with the first A and AAAA records up to the
+// answer limit, the CNAMEs of a chain are always kept.
+func (s *Server) limitAnswer(records []dns.RR) []dns.RR {
+	if s.answerLimit <= 0 || len(records) <= s.answerLimit {
+		return records
+	}
+	kept := make([]dns.RR, 0, s.answerLimit)
+	n := 0
+	for _, r := range records {
+		if r.Header().Rrtype == dns.TypeCNAME {
+			kept = append(kept, r)
+			continue
+		}
+		if n < s.answerLimit {
+			kept = append(kept, r)
+			n++
+		}
+	}
+	return kept
+}
+
+// limitSRV returns the first SRV records up to the answer limit, and the
+// records in extra for their targets.
+func (s *Server) limitSRV(records, extra []dns.RR) ([]dns.RR, []dns.RR) {
+	if s.answerLimit <= 0 || len(records) <= s.answerLimit {
+		return records, extra
+	}
+	records = records[:s.answerLimit]
+	targets := make(map[string]bool, len(records))
+	for _, r := range records {
+		targets[strings.ToLower(r.(*dns.SRV).Target)] = true
+	}
+	var kept []dns.RR
+	for _, r := range extra {
+		if targets[strings.ToLower(r.Header().Name)] {
+			kept = append(kept, r)
+		}
+	}
+	return records, kept
+}
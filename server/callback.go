@@ -12,7 +12,6 @@ import (
 	"github.com/skynetservices/skydns1/registry"
 	"log"
 	"net/http"
-	"strings"
 )
 
 // Handle API add callback requests.
@@ -36,43 +35,62 @@ func (s *Server) addCallbackHTTPHandler(w http.ResponseWriter, req *http.Request
 	}
 
 	cb.UUID = uuid
-	// Lookup the service(s)
-	// TODO: this should be a function call (or method)
-	key := cb.Region + "." + strings.Replace(cb.Version, ".", "-", -1) + "." + cb.Name + "." + cb.Environment
-	key = strings.ToLower(key)
-	services, err := s.registry.Get(key)
-	if err != nil || len(services) == 0 {
-		log.Println("Service not found for callback", key)
-		http.Error(w, err.Error(), http.StatusNotFound)
+	if cb.Reply == "" || cb.Port == 0 {
+		http.Error(w, "Reply and Port required", http.StatusBadRequest)
 		return
 	}
-	// Reset to save memory, only used so find the services(s).
+	for _, e := range cb.Events {
+		if !msg.ValidEvent(e) {
+			http.Error(w, "Unknown event: "+e, http.StatusBadRequest)
+			return
+		}
+	}
+	// The callback is stored with its domain pattern, so it also applies to
+	// services that are added later.
+	cb.Domain = cb.Pattern()
+	// Reset to save memory, only used to create the domain pattern.
 	cb.Name = ""
 	cb.Version = ""
 	cb.Environment = ""
 	cb.Region = ""
 	cb.Host = ""
 
-	notExists := 0
-	for _, serv := range services {
-		if _, err := s.raftServer.Do(NewAddCallbackCommand(serv, cb)); err != nil {
-			switch err {
-			case registry.ErrNotExists:
-				notExists++
-				continue
-			case raft.NotLeaderError:
-				s.redirectToLeader(w, req)
-				return
-			default:
-				log.Println("Error: ", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+	if _, err := s.raftServer.Do(NewSetCallbackCommand(cb)); err != nil {
+		switch err {
+		case raft.NotLeaderError:
+			s.redirectToLeader(w, req)
+		default:
+			log.Println("Error: ", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
-	}
-	if notExists == len(services) {
-		http.Error(w, registry.ErrNotExists.Error(), http.StatusNotFound)
 		return
 	}
 	w.WriteHeader(http.StatusCreated)
 }
+
+// Handle API remove callback requests.
+func (s *Server) removeCallbackHTTPHandler(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	var uuid string
+	var ok bool
+
+	if uuid, ok = vars["uuid"]; !ok {
+		http.Error(w, "UUID required", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := s.raftServer.Do(NewRemoveCallbackCommand(uuid)); err != nil {
+		switch err {
+		case registry.ErrCallbackNotExists:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case raft.NotLeaderError:
+			s.redirectToLeader(w, req)
+		default:
+			log.Println("Error: ", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
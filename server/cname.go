@@ -0,0 +1,94 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns1/msg"
+)
+
+const maxCNAMEDepth = 8 // longest chain of CNAMEs followed in our domain, guards against loops
+
+// hostRecords returns the records for the services in hosts, whose Host is a
+// hostname, in reply to q. When the name has no addresses of any type (alone)
+// this is a CNAME to one of the hostnames of the nearest region, followed by
+// the records of the hostname. Otherwise the addresses of the hostnames in our
+// domain are returned as records of q.Name, as a CNAME can not be next to other
+// data, RFC 2181 section 10.1. Hostnames outside our domain are then left out,
+// their addresses are not ours to serve (or sign). Only when recurse is true
+// the nameservers are asked for the records outside our domain.
+func (s *Server) hostRecords(q dns.Question, region string, client net.IP, recurse, alone bool, hosts []msg.Service, depth int) []dns.RR {
+	if depth >= maxCNAMEDepth {
+		return nil
+	}
+	var targets []string
+	ttls := make(map[string]uint32, len(hosts))
+	regions := make(map[string]string, len(hosts)) // of the nearest service with the hostname
+	for _, serv := range hosts {
+		t := dns.Fqdn(strings.ToLower(serv.Host))
+		if _, ok := dns.IsDomainName(t); !ok {
+			continue
+		}
+		ttl, ok := ttls[t]
+		if !ok {
+			targets = append(targets, t)
+			regions[t] = strings.ToLower(serv.Region)
+		}
+		if !ok || serv.TTL < ttl {
+			ttls[t] = serv.TTL
+		}
+	}
+
+	if alone && len(targets) > 0 {
+		// hosts are ordered by region, the first is the nearest
+		var cnames []dns.RR
+		for _, t := range targets {
+			if regions[t] == regions[targets[0]] {
+				cnames = append(cnames, &dns.CNAME{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttls[t]}, Target: t})
+			}
+		}
+		s.shuffle(cnames, unitWeight, client, 1)
+		t := cnames[0].(*dns.CNAME).Target
+		return append([]dns.RR{cnames[0]}, s.resolve(dns.Question{Name: t, Qtype: q.Qtype, Qclass: q.Qclass}, region, client, recurse, depth+1)...)
+	}
+
+	apex := dns.Fqdn(s.domain)
+	var records []dns.RR
+	for _, t := range targets {
+		if !dns.IsSubDomain(apex, t) {
+			continue
+		}
+		for _, r := range s.resolve(dns.Question{Name: t, Qtype: q.Qtype, Qclass: q.Qclass}, region, client, recurse, depth+1) {
+			// Not the addresses at the end of a CNAME chain that
+			// leaves our domain.
+			if r.Header().Rrtype != q.Qtype || !dns.IsSubDomain(apex, r.Header().Name) {
+				continue
+			}
+			r = dns.Copy(r)
+			r.Header().Name = q.Name
+			if r.Header().Ttl > ttls[t] {
+				r.Header().Ttl = ttls[t]
+			}
+			records = append(records, r)
+		}
+	}
+	return records
+}
+
+// resolve returns the records for the hostname q.Name: from the registry when
+// it is in our domain, from the nameservers otherwise if recurse is true.
+func (s *Server) resolve(q dns.Question, region string, client net.IP, recurse bool, depth int) []dns.RR {
+	if dns.IsSubDomain(dns.Fqdn(s.domain), q.Name) {
+		records, _ := s.aRecords(q, region, client, recurse, depth)
+		return records
+	}
+	if !recurse {
+		return nil
+	}
+	return s.lookup(q.Name, q.Qtype)
+}
@@ -7,7 +7,6 @@ package server
 import (
 	"github.com/goraft/raft"
 	"github.com/skynetservices/skydns1/msg"
-	"github.com/skynetservices/skydns1/registry"
 	"log"
 	"time"
 )
@@ -28,12 +27,16 @@ func NewAddServiceCommand(s msg.Service) *AddServiceCommand {
 func (c *AddServiceCommand) CommandName() string { return "add-service" }
 
 // Adds service to registry
-func (c *AddServiceCommand) Apply(server raft.Server) (interface{}, error) {
-	reg := server.Context().(registry.Registry)
-	err := reg.Add(c.Service)
+func (c *AddServiceCommand) Apply(ctx raft.Context) (interface{}, error) {
+	s := ctx.Server().Context().(*Server)
+	err := s.registry.Add(c.Service)
 
 	if err == nil {
 		log.Println("Added Service:", c.Service)
+		s.zoneChanged(ctx.CurrentIndex())
+		e := msg.Event{Index: ctx.CurrentIndex(), Type: msg.EventAdd, Service: c.Service}
+		s.watch.publish(e)
+		s.deliverCallbacks(e)
 	}
 
 	return c.Service, err
@@ -54,37 +57,60 @@ func NewUpdateTTLCommand(uuid string, ttl uint32) *UpdateTTLCommand {
 func (c *UpdateTTLCommand) CommandName() string { return "update-ttl" }
 
 // Updates TTL in registry
-func (c *UpdateTTLCommand) Apply(server raft.Server) (interface{}, error) {
-	reg := server.Context().(registry.Registry)
-	err := reg.UpdateTTL(c.UUID, c.TTL, c.Expires)
+func (c *UpdateTTLCommand) Apply(ctx raft.Context) (interface{}, error) {
+	s := ctx.Server().Context().(*Server)
+	old, _ := s.registry.Lookup(c.UUID)
+	err := s.registry.UpdateTTL(c.UUID, c.TTL, c.Expires)
 
 	if err == nil {
 		log.Println("Updated Service TTL:", c.UUID, c.TTL)
+		// A heartbeat only changes the zone when the TTL changes
+		if old.TTL != c.TTL {
+			s.zoneChanged(ctx.CurrentIndex())
+		}
+		if serv, err := s.registry.Lookup(c.UUID); err == nil {
+			e := msg.Event{Index: ctx.CurrentIndex(), Type: msg.EventUpdateTTL, Service: serv}
+			s.watch.publish(e)
+			s.deliverCallbacks(e)
+		}
 	}
 
 	return c.UUID, err
 }
 
 type RemoveServiceCommand struct {
-	UUID string
+	UUID    string
+	Expired bool // removed by the leader, because the TTL expired
 }
 
 // Creates a new RemoveServiceCommand
 func NewRemoveServiceCommand(uuid string) *RemoveServiceCommand {
-	return &RemoveServiceCommand{uuid}
+	return &RemoveServiceCommand{uuid, false}
+}
+
+// NewExpireServiceCommand returns a RemoveServiceCommand for a service whose TTL has expired.
+func NewExpireServiceCommand(uuid string) *RemoveServiceCommand {
+	return &RemoveServiceCommand{uuid, true}
 }
 
 // Name of command
 func (c *RemoveServiceCommand) CommandName() string { return "remove-service" }
 
 // Removes service from the registry
-func (c *RemoveServiceCommand) Apply(server raft.Server) (interface{}, error) {
-
-	reg := server.Context().(registry.Registry)
-	err := reg.RemoveUUID(c.UUID)
+func (c *RemoveServiceCommand) Apply(ctx raft.Context) (interface{}, error) {
+	s := ctx.Server().Context().(*Server)
+	serv, _ := s.registry.Lookup(c.UUID)
+	err := s.registry.RemoveUUID(c.UUID)
 
 	if err == nil {
 		log.Println("Removed Service:", c.UUID)
+		s.zoneChanged(ctx.CurrentIndex())
+		e := msg.Event{Index: ctx.CurrentIndex(), Type: msg.EventRemove, Service: serv}
+		if c.Expired {
+			e.Type = msg.EventExpire
+		}
+		s.watch.publish(e)
+		s.deliverCallbacks(e)
 	}
 
 	return c.UUID, err
@@ -105,11 +131,189 @@ func NewAddCallbackCommand(s msg.Service, c msg.Callback) *AddCallbackCommand {
 
 func (c *AddCallbackCommand) CommandName() string { return "add-callback" }
 
-func (c *AddCallbackCommand) Apply(server raft.Server) (interface{}, error) {
-	reg := server.Context().(registry.Registry)
-	err := reg.AddCallback(c.Service, c.Callback)
+func (c *AddCallbackCommand) Apply(ctx raft.Context) (interface{}, error) {
+	s := ctx.Server().Context().(*Server)
+	err := s.registry.AddCallback(c.Service, c.Callback)
 	if err == nil {
 		log.Println("Added Callback:", c.Service, c.Callback)
 	}
 	return c.Service, err
 }
+
+// Command for adding a callback for the services matching a domain pattern
+type SetCallbackCommand struct {
+	Callback msg.Callback
+}
+
+// NewSetCallbackCommand returns a new SetCallbackCommand.
+func NewSetCallbackCommand(c msg.Callback) *SetCallbackCommand {
+	return &SetCallbackCommand{c}
+}
+
+func (c *SetCallbackCommand) CommandName() string { return "set-callback" }
+
+// Adds or replaces the callback in the registry
+func (c *SetCallbackCommand) Apply(ctx raft.Context) (interface{}, error) {
+	s := ctx.Server().Context().(*Server)
+	s.registry.SetCallback(c.Callback)
+	log.Println("Set Callback:", c.Callback.UUID, c.Callback.Pattern())
+	return c.Callback, nil
+}
+
+type RemoveCallbackCommand struct {
+	UUID string
+}
+
+// NewRemoveCallbackCommand returns a new RemoveCallbackCommand.
+func NewRemoveCallbackCommand(uuid string) *RemoveCallbackCommand {
+	return &RemoveCallbackCommand{uuid}
+}
+
+func (c *RemoveCallbackCommand) CommandName() string { return "remove-callback" }
+
+// Removes the callback from the registry
+func (c *RemoveCallbackCommand) Apply(ctx raft.Context) (interface{}, error) {
+	s := ctx.Server().Context().(*Server)
+	err := s.registry.RemoveCallback(c.UUID)
+	if err == nil {
+		log.Println("Removed Callback:", c.UUID)
+	}
+	return c.UUID, err
+}
+
+type SetLoadCommand struct {
+	Host string
+	Load msg.Load
+}
+
+// NewSetLoadCommand returns a new SetLoadCommand, the report is timestamped
+// here so it is the same on all members.
+func NewSetLoadCommand(host string, l msg.Load) *SetLoadCommand {
+	l.Reported = time.Now()
+	return &SetLoadCommand{host, l}
+}
+
+func (c *SetLoadCommand) CommandName() string { return "set-load" }
+
+// Stores the load report of a host in the registry. The SRV weights change,
+// but the zone does not: it has equal weights, so hosts reporting their load
+// do not change the serial all the time.
+func (c *SetLoadCommand) Apply(ctx raft.Context) (interface{}, error) {
+	s := ctx.Server().Context().(*Server)
+	s.registry.SetLoad(c.Host, c.Load)
+	return c.Host, nil
+}
+
+type SetTopologyCommand struct {
+	Topology msg.Topology
+}
+
+// NewSetTopologyCommand returns a new SetTopologyCommand.
+func NewSetTopologyCommand(t msg.Topology) *SetTopologyCommand {
+	return &SetTopologyCommand{t}
+}
+
+func (c *SetTopologyCommand) CommandName() string { return "set-topology" }
+
+// Replaces the region topology in the registry
+func (c *SetTopologyCommand) Apply(ctx raft.Context) (interface{}, error) {
+	s := ctx.Server().Context().(*Server)
+	s.registry.SetTopology(c.Topology)
+	log.Println("Set Region Topology")
+	// The SRV priorities change
+	s.zoneChanged(ctx.CurrentIndex())
+	return nil, nil
+}
+
+type SetStubZoneCommand struct {
+	Domain      string
+	Nameservers []string
+}
+
+// NewSetStubZoneCommand returns a new SetStubZoneCommand.
+func NewSetStubZoneCommand(domain string, nameservers []string) *SetStubZoneCommand {
+	return &SetStubZoneCommand{domain, nameservers}
+}
+
+func (c *SetStubZoneCommand) CommandName() string { return "set-stub-zone" }
+
+// Stores the nameservers of a stub zone in the registry
+func (c *SetStubZoneCommand) Apply(ctx raft.Context) (interface{}, error) {
+	s := ctx.Server().Context().(*Server)
+	s.registry.SetStubZone(c.Domain, c.Nameservers)
+	s.updateStubZones()
+	log.Println("Set Stub Zone:", c.Domain, c.Nameservers)
+	return c.Domain, nil
+}
+
+type RemoveStubZoneCommand struct {
+	Domain string
+}
+
+// NewRemoveStubZoneCommand returns a new RemoveStubZoneCommand.
+func NewRemoveStubZoneCommand(domain string) *RemoveStubZoneCommand {
+	return &RemoveStubZoneCommand{domain}
+}
+
+func (c *RemoveStubZoneCommand) CommandName() string { return "remove-stub-zone" }
+
+// Removes a stub zone from the registry
+func (c *RemoveStubZoneCommand) Apply(ctx raft.Context) (interface{}, error) {
+	s := ctx.Server().Context().(*Server)
+	err := s.registry.RemoveStubZone(c.Domain)
+	if err == nil {
+		s.updateStubZones()
+		log.Println("Removed Stub Zone:", c.Domain)
+	}
+	return c.Domain, err
+}
+
+type SetKeysCommand struct {
+	Keys []msg.Key
+}
+
+// NewSetKeysCommand returns a new SetKeysCommand.
+func NewSetKeysCommand(keys []msg.Key) *SetKeysCommand {
+	return &SetKeysCommand{keys}
+}
+
+func (c *SetKeysCommand) CommandName() string { return "set-keys" }
+
+// Replaces the DNSSEC keys in the registry
+func (c *SetKeysCommand) Apply(ctx raft.Context) (interface{}, error) {
+	s := ctx.Server().Context().(*Server)
+	s.registry.SetKeys(c.Keys)
+	log.Println("Set DNSSEC Keys:", len(c.Keys))
+	// The DNSKEY RRset changes
+	s.zoneChanged(ctx.CurrentIndex())
+	return nil, nil
+}
+
+type SetHealthCommand struct {
+	UUID   string
+	Health msg.Health
+}
+
+// NewSetHealthCommand returns a new SetHealthCommand.
+func NewSetHealthCommand(uuid string, h msg.Health) *SetHealthCommand {
+	return &SetHealthCommand{uuid, h}
+}
+
+func (c *SetHealthCommand) CommandName() string { return "set-health" }
+
+// Sets the health of a service in the registry
+func (c *SetHealthCommand) Apply(ctx raft.Context) (interface{}, error) {
+	s := ctx.Server().Context().(*Server)
+	err := s.registry.SetHealth(c.UUID, c.Health)
+
+	if err == nil {
+		log.Println("Set Service Health:", c.UUID, c.Health.Healthy)
+		s.zoneChanged(ctx.CurrentIndex())
+		if serv, err := s.registry.Lookup(c.UUID); err == nil {
+			e := msg.Event{Index: ctx.CurrentIndex(), Type: msg.EventHealth, Service: serv}
+			s.watch.publish(e)
+			s.deliverCallbacks(e)
+		}
+	}
+	return c.UUID, err
+}
@@ -0,0 +1,184 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/skynetservices/skydns1/msg"
+	"github.com/skynetservices/skydns1/stats"
+)
+
+const (
+	deliveryQueue    = 1024            // maximum number of queued callbacks
+	deliveryWorkers  = 4               // number of callbacks delivered concurrently
+	deliveryAttempts = 5               // attempts before a callback is given up
+	deliveryBackoff  = 1 * time.Second // wait before the first retry, doubled on every attempt
+	deliveryFailures = 100             // number of failed callbacks kept
+)
+
+var errQueueFull = errors.New("Callback queue is full")
+
+// delivery is a callback that must be delivered.
+type delivery struct {
+	Callback msg.Callback
+	Event    msg.Event
+	Attempts int
+	Error    string    // last error
+	Time     time.Time // time of the last attempt
+}
+
+// deliverer delivers callbacks asynchronously, it retries failed callbacks with
+// an exponential backoff. Every callback has its own queue, so it receives the
+// events in the order they happened, also when a delivery has to be retried.
+// Only the leader delivers callbacks.
+type deliverer struct {
+	sync.Mutex
+	queues    map[string][]*delivery // per callback UUID, the first is being delivered
+	queued    int
+	started   bool
+	workers   chan bool // limits the number of callbacks delivered concurrently
+	delivered uint64
+	failed    uint64
+	failures  []*delivery // the last deliveryFailures failed callbacks, oldest first
+}
+
+func newDeliverer() *deliverer {
+	return &deliverer{
+		queues:   make(map[string][]*delivery),
+		workers:  make(chan bool, deliveryWorkers),
+		failures: make([]*delivery, 0, 10),
+	}
+}
+
+// start starts delivering the queued callbacks.
+func (d *deliverer) start() {
+	d.Lock()
+	defer d.Unlock()
+	d.started = true
+	for uuid := range d.queues {
+		go d.work(uuid)
+	}
+}
+
+// enqueue queues a callback for delivery, it never blocks.
+func (d *deliverer) enqueue(dl *delivery) {
+	d.Lock()
+	if d.queued >= deliveryQueue {
+		d.Unlock()
+		d.fail(dl, errQueueFull)
+		return
+	}
+	uuid := dl.Callback.UUID
+	d.queues[uuid] = append(d.queues[uuid], dl)
+	d.queued++
+	if d.started && len(d.queues[uuid]) == 1 {
+		go d.work(uuid)
+	}
+	d.Unlock()
+}
+
+// work delivers the queued callbacks of callback uuid one by one, it returns
+// when the queue is empty.
+func (d *deliverer) work(uuid string) {
+	for {
+		d.Lock()
+		dl := d.queues[uuid][0]
+		d.Unlock()
+
+		d.deliver(dl)
+
+		d.Lock()
+		d.queued--
+		if q := d.queues[uuid][1:]; len(q) > 0 {
+			d.queues[uuid] = q
+			d.Unlock()
+			continue
+		}
+		delete(d.queues, uuid)
+		d.Unlock()
+		return
+	}
+}
+
+// deliver calls a callback until it succeeds or has used all its attempts.
+func (d *deliverer) deliver(dl *delivery) {
+	for {
+		d.workers <- true
+		dl.Attempts++
+		dl.Time = time.Now()
+		err := dl.Callback.Call(dl.Event)
+		<-d.workers
+		if err == nil {
+			stats.CallbackCount.Inc(1)
+			d.Lock()
+			d.delivered++
+			d.Unlock()
+			return
+		}
+		if dl.Attempts >= deliveryAttempts {
+			d.fail(dl, err)
+			return
+		}
+		log.Printf("Error: callback %s for service %s failed (attempt %d): %s", dl.Callback.UUID, dl.Event.Service.UUID, dl.Attempts, err)
+		dl.Error = err.Error()
+		time.Sleep(deliveryBackoff << uint(dl.Attempts-1))
+	}
+}
+
+// fail records a callback that could not be delivered.
+func (d *deliverer) fail(dl *delivery, err error) {
+	log.Printf("Error: giving up on callback %s for service %s: %s", dl.Callback.UUID, dl.Event.Service.UUID, err)
+	stats.CallbackFailedCount.Inc(1)
+	dl.Error = err.Error()
+
+	d.Lock()
+	defer d.Unlock()
+	d.failed++
+	if len(d.failures) == deliveryFailures {
+		copy(d.failures, d.failures[1:])
+		d.failures = d.failures[:len(d.failures)-1]
+	}
+	d.failures = append(d.failures, dl)
+}
+
+// deliverCallbacks queues the callbacks that want event e, but only if we are the leader.
+func (s *Server) deliverCallbacks(e msg.Event) {
+	if !s.IsLeader() {
+		return
+	}
+	for _, c := range s.registry.GetCallbacks(e.Service) {
+		if !c.Wants(e.Type) {
+			continue
+		}
+		log.Println("Queueing callback", c.UUID, "for", e.Type, "of service", e.Service.UUID)
+		s.deliverer.enqueue(&delivery{Callback: c, Event: e})
+	}
+}
+
+// Handle API callback status requests.
+func (s *Server) getCallbacksHTTPHandler(w http.ResponseWriter, req *http.Request) {
+	s.deliverer.Lock()
+	status := struct {
+		Queued    int
+		Delivered uint64
+		Failed    uint64
+		Failures  []*delivery
+	}{s.deliverer.queued, s.deliverer.delivered, s.deliverer.failed, s.deliverer.failures}
+	b, err := json.Marshal(status)
+	s.deliverer.Unlock()
+
+	if err != nil {
+		log.Println("Error: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
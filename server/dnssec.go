@@ -5,10 +5,13 @@
 package server
 
 import (
+	"container/list"
 	"crypto/sha1"
 	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns1/stats"
 	"log"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -16,7 +19,13 @@ import (
 
 const origTTL uint32 = 60
 
-var cache *sigCache = newCache()
+const (
+	sigCacheSize   = 10000              // default number of cached signatures
+	sigValidity    = 7 * 24 * time.Hour // sign for a week
+	sigRefresh     = 2 * 24 * time.Hour // signatures expiring within this time are replaced
+	resignInterval = 24 * time.Hour     // the zone is signed in the background at least this often
+)
+
 var inflight *single = new(single)
 
 // ParseKeyFile read a DNSSEC keyfile as generated by dnssec-keygen or other
@@ -42,6 +51,8 @@ func ParseKeyFile(file string) (*dns.DNSKEY, dns.PrivateKey, error) {
 	return k.(*dns.DNSKEY), p, nil
 }
 
+// SetKeys makes the server sign with the DNSKEY k and its private key p, which
+// must be the same on every member.
 func (s *Server) SetKeys(k *dns.DNSKEY, p dns.PrivateKey) {
 	s.dnsKey = k
 	s.keyTag = k.KeyTag()
@@ -49,8 +60,20 @@ func (s *Server) SetKeys(k *dns.DNSKEY, p dns.PrivateKey) {
 	s.registry.DNSSEC(true)
 }
 
+// SetNSEC3 makes the server use NSEC3 instead of NSEC for authenticated denial
+// of existence. The salt is hex encoded, an empty salt is allowed.
+func (s *Server) SetNSEC3(salt string, iterations uint16) {
+	s.nsec3Param = &dns.NSEC3PARAM{Hdr: dns.RR_Header{Name: dns.Fqdn(s.domain), Rrtype: dns.TypeNSEC3PARAM, Class: dns.ClassINET, Ttl: 0},
+		Hash: dns.SHA1, Iterations: iterations, SaltLength: uint8(len(salt) / 2), Salt: salt}
+	s.registry.NSEC3(s.domain, salt, iterations)
+}
+
 // nsec creates (if needed) NSEC records that are included in the reply.
 func (s *Server) nsec(m *dns.Msg) {
+	if s.nsec3Param != nil {
+		s.nsec3(m)
+		return
+	}
 	if m.Rcode == dns.RcodeNameError {
 		// qname nsec
 		nsec1 := s.newNSEC(m.Question[0].Name)
@@ -71,99 +94,128 @@ func (s *Server) nsec(m *dns.Msg) {
 	}
 }
 
-// sign signs a message m, it takes care of negative or nodata responses as
-// well by synthesising NSEC records. It will also cache the signatures, using
-// a hash of the signed data as a key.
+// sign signs a message m with keys, it takes care of negative or nodata
+// responses as well by synthesising NSEC records. It will also cache the
+// signatures, using a hash of the signed data and the key tag as a key.
 // We also fake the origin TTL in the signature, because we don't want to
 // throw away signatures when services decide to have longer TTL. So we just
 // set the origTTL to 60.
-func (s *Server) sign(m *dns.Msg, bufsize uint16) {
+func (s *Server) sign(m *dns.Msg, keys *zoneKeys) {
 	now := time.Now().UTC()
-	incep := uint32(now.Add(-2 * time.Hour).Unix())     // 2 hours, be sure to catch daylight saving time and such
-	expir := uint32(now.Add(7 * 24 * time.Hour).Unix()) // sign for a week
+	m.Answer = append(m.Answer, s.signatures(m.Answer, keys, now)...)
+	m.Ns = append(m.Ns, s.signatures(m.Ns, keys, now)...)
+	// TODO(miek): Forget the additional section for now
+	o := new(dns.OPT)
+	o.Hdr.Name = "."
+	o.Hdr.Rrtype = dns.TypeOPT
+	o.SetDo()
+	o.SetUDPSize(4096)
+	m.Extra = append(m.Extra, o)
+	return
+}
 
-	// TODO(miek): repeating this two times?
-	for _, r := range rrSets(m.Answer) {
-		if r[0].Header().Rrtype == dns.TypeRRSIG {
+// signatures returns the signatures for the RRsets in rrs, made at time now.
+// The DNSKEY RRset is signed by the key signing keys, the others by the zone
+// signing keys. Cached signatures are used until they are about to expire.
+// RRsets outside our domain, such as the targets of CNAMEs, are not signed.
+func (s *Server) signatures(rrs []dns.RR, keys *zoneKeys, now time.Time) []dns.RR {
+	incep := uint32(now.Add(-2 * time.Hour).Unix()) // 2 hours, be sure to catch daylight saving time and such
+	expir := uint32(now.Add(sigValidity).Unix())
+	apex := dns.Fqdn(s.domain)
+
+	var sigs []dns.RR
+	for _, r := range rrSets(rrs) {
+		if r[0].Header().Rrtype == dns.TypeRRSIG || !dns.IsSubDomain(apex, r[0].Header().Name) {
 			continue
 		}
-		key := cache.key(r)
-		if s := cache.search(key); s != nil {
-			if s.ValidityPeriod(now.Add(-24 * time.Hour)) {
-				m.Answer = append(m.Answer, s)
-				continue
-			}
-			cache.remove(key)
+		signers := keys.zsk
+		if r[0].Header().Rrtype == dns.TypeDNSKEY {
+			signers = keys.ksk
 		}
-		sig, err, shared := inflight.Do(key, func() (*dns.RRSIG, error) {
-			sig1 := s.newRRSIG(incep, expir)
-			e := sig1.Sign(s.PrivateKey(), r)
-			if e != nil {
-				log.Printf("Failed to sign: %s\n", e.Error())
+		for _, k := range signers {
+			key := sigKey(r, k.tag)
+			if sig := s.sigs.search(key); sig != nil {
+				if sig.ValidityPeriod(now.Add(sigRefresh)) {
+					sigs = append(sigs, sig)
+					continue
+				}
+				s.sigs.remove(key)
 			}
-			return sig1, e
-		})
-		if err != nil {
-			continue
-		}
-		if !shared {
-			// is it possible to miss this, due the the c.dups > 0 in Do()? TODO(miek)
-			cache.insert(key, sig)
-		}
-		m.Answer = append(m.Answer, dns.Copy(sig).(*dns.RRSIG))
-	}
-	for _, r := range rrSets(m.Ns) {
-		if r[0].Header().Rrtype == dns.TypeRRSIG {
-			continue
-		}
-		key := cache.key(r)
-		if s := cache.search(key); s != nil {
-			if s.ValidityPeriod(now.Add(-24 * time.Hour)) {
-				m.Ns = append(m.Ns, s)
+			sig, err, shared := inflight.Do(key, func() (*dns.RRSIG, error) {
+				sig1 := newRRSIG(k, incep, expir)
+				e := sig1.Sign(k.private, r)
+				if e != nil {
+					log.Printf("Failed to sign: %s\n", e.Error())
+				}
+				return sig1, e
+			})
+			if err != nil {
 				continue
 			}
-			cache.remove(key)
-		}
-		sig, err, shared := inflight.Do(key, func() (*dns.RRSIG, error) {
-			sig1 := s.newRRSIG(incep, expir)
-			e := sig1.Sign(s.PrivateKey(), r)
-			if e != nil {
-				log.Printf("Failed to sign: %s\n", e.Error())
+			if !shared {
+				// is it possible to miss this, due the the c.dups > 0 in Do()? TODO(miek)
+				s.sigs.insert(key, sig)
 			}
-			return sig1, e
-		})
-		if err != nil {
-			continue
+			sigs = append(sigs, dns.Copy(sig).(*dns.RRSIG))
 		}
-		if !shared {
-			// is it possible to miss this, due the the c.dups > 0 in Do()? TODO(miek)
-			cache.insert(key, sig)
+	}
+	return sigs
+}
+
+// SetSignatureCache sets the number of DNSSEC signatures that are cached, 0
+// disables the cache.
+func (s *Server) SetSignatureCache(size int) {
+	s.sigs = newSigCache(size)
+}
+
+// resign signs the zone in the background, it never blocks.
+func (s *Server) resign() {
+	if s.keys == nil && s.dnsKey == nil {
+		return
+	}
+	select {
+	case s.resignPending <- true:
+	default:
+		// signing is already pending
+	}
+}
+
+// resignLoop signs the zone when it changed, and every resignInterval to
+// replace the signatures that are about to expire, so the signatures are
+// cached before they are queried.
+func (s *Server) resignLoop() {
+	tick := time.NewTicker(resignInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-s.resignPending:
+		case <-tick.C:
+		}
+		if keys := s.zoneKeys(time.Now().UTC()); keys != nil {
+			s.signZone(keys)
 		}
-		m.Ns = append(m.Ns, dns.Copy(sig).(*dns.RRSIG))
 	}
-	// TODO(miek): Forget the additional section for now
-	if bufsize >= 512 || bufsize <= 4096 {
-		m.Truncated = m.Len() > int(bufsize)
+}
+
+// signZone signs every RRset in the zone with keys and caches the signatures.
+func (s *Server) signZone(keys *zoneKeys) {
+	rrs := append(s.createSOA(), s.zone(s.serial())...)
+	for _, k := range keys.published {
+		rrs = append(rrs, k)
 	}
-	o := new(dns.OPT)
-	o.Hdr.Name = "."
-	o.Hdr.Rrtype = dns.TypeOPT
-	o.SetDo()
-	o.SetUDPSize(4096)
-	m.Extra = append(m.Extra, o)
-	return
+	s.signatures(rrs, keys, time.Now().UTC())
 }
 
-func (s *Server) newRRSIG(incep, expir uint32) *dns.RRSIG {
+func newRRSIG(k *signingKey, incep, expir uint32) *dns.RRSIG {
 	sig := new(dns.RRSIG)
 	sig.Hdr.Rrtype = dns.TypeRRSIG
 	sig.Hdr.Ttl = origTTL
 	sig.OrigTtl = origTTL
-	sig.Algorithm = s.PublicKey().Algorithm
-	sig.KeyTag = s.KeyTag()
+	sig.Algorithm = k.dnskey.Algorithm
+	sig.KeyTag = k.tag
 	sig.Inception = incep
 	sig.Expiration = expir
-	sig.SignerName = s.PublicKey().Hdr.Name
+	sig.SignerName = k.dnskey.Hdr.Name
 	return sig
 }
 
@@ -215,49 +267,80 @@ func rrSets(rrs []dns.RR) map[rrset][]dns.RR {
 	return nil
 }
 
+// sigCache is a cache of signatures, when it is full the least recently used
+// signature is removed.
 type sigCache struct {
-	sync.RWMutex
-	m map[string]*dns.RRSIG
+	sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List // of *sigEntry, most recently used first
 }
 
-func newCache() *sigCache {
-	c := new(sigCache)
-	c.m = make(map[string]*dns.RRSIG)
-	return c
+type sigEntry struct {
+	key string
+	sig *dns.RRSIG
+}
+
+func newSigCache(size int) *sigCache {
+	return &sigCache{size: size, entries: make(map[string]*list.Element), lru: list.New()}
 }
 
 func (c *sigCache) remove(s string) {
-	delete(c.m, s)
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.entries[s]; ok {
+		c.lru.Remove(e)
+		delete(c.entries, s)
+	}
 }
 
 func (c *sigCache) insert(s string, r *dns.RRSIG) {
+	if c.size <= 0 {
+		return
+	}
 	c.Lock()
 	defer c.Unlock()
-	if _, ok := c.m[s]; !ok {
-		c.m[s] = r
+	if e, ok := c.entries[s]; ok {
+		e.Value.(*sigEntry).sig = r
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[s] = c.lru.PushFront(&sigEntry{s, r})
+	for c.lru.Len() > c.size {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.entries, e.Value.(*sigEntry).key)
+		stats.SignatureCacheEvictCount.Inc(1)
 	}
 }
 
 func (c *sigCache) search(s string) *dns.RRSIG {
-	c.RLock()
-	defer c.RUnlock()
-	if s, ok := c.m[s]; ok {
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.entries[s]; ok {
+		c.lru.MoveToFront(e)
+		stats.SignatureCacheHitCount.Inc(1)
 		// we want to return a copy here, because if we didn't the RRSIG
-		// could be removed by another goroutine before the packet containing
+		// could be changed by another goroutine before the packet containing
 		// this signature is send out.
-		log.Println("DNS Signature retrieved from cache")
-		return dns.Copy(s).(*dns.RRSIG)
+		return dns.Copy(e.Value.(*sigEntry).sig).(*dns.RRSIG)
 	}
+	stats.SignatureCacheMissCount.Inc(1)
 	return nil
 }
 
-// key uses the name, type and rdata, which is serialized and then hashed as the
-// key for the lookup
-func (c *sigCache) key(rrs []dns.RR) string {
+// sigKey uses the name, type and rdata, which is serialized and then hashed,
+// and the tag of the signing key as the key for the lookup. The order of the
+// records does not matter, so round robin does not fill the cache with
+// signatures of the same RRset.
+func sigKey(rrs []dns.RR, tag uint16) string {
 	h := sha1.New()
-	i := []byte(rrs[0].Header().Name)
-	i = append(i, packUint16(rrs[0].Header().Rrtype)...)
+	h.Write([]byte(strings.ToLower(rrs[0].Header().Name)))
+	h.Write(packUint16(rrs[0].Header().Rrtype))
+	h.Write(packUint16(tag))
+	rdata := make([]string, 0, len(rrs))
 	for _, r := range rrs {
+		var i []byte
 		switch t := r.(type) { // we only do a few type, serialize these manually
 		case *dns.SOA:
 			i = append(i, packUint32(t.Serial)...)
@@ -265,22 +348,49 @@ func (c *sigCache) key(rrs []dns.RR) string {
 		case *dns.SRV:
 			i = append(i, packUint16(t.Priority)...)
 			i = append(i, packUint16(t.Weight)...)
-			i = append(i, packUint16(t.Weight)...)
+			i = append(i, packUint16(t.Port)...)
+			i = append(i, []byte(t.Target)...)
+		case *dns.CNAME:
 			i = append(i, []byte(t.Target)...)
 		case *dns.A:
 			i = append(i, []byte(t.A)...)
 		case *dns.AAAA:
 			i = append(i, []byte(t.AAAA)...)
+		case *dns.TXT:
+			for _, t := range t.Txt {
+				i = append(i, []byte(t)...)
+			}
 		case *dns.DNSKEY:
-			// Need nothing more, the rdata stays the same during a run
+			// The RRset changes during a key rollover
+			i = append(i, packUint16(t.Flags)...)
+			i = append(i, []byte(t.PublicKey)...)
 		case *dns.NSEC:
 			i = append(i, []byte(t.NextDomain)...)
 			// bitmap does not differentiate
+		case *dns.NSEC3:
+			i = append(i, t.Hash, t.Flags)
+			i = append(i, []byte(t.NextDomain)...)
+			i = append(i, []byte(t.Salt)...)
+			i = append(i, packUint16(t.Iterations)...)
+			// NODATA proofs leave out the type of the question
+			for _, b := range t.TypeBitMap {
+				i = append(i, packUint16(b)...)
+			}
+		case *dns.NSEC3PARAM:
+			i = append(i, []byte(t.Salt)...)
+			i = append(i, packUint16(t.Iterations)...)
 		default:
 			log.Printf("DNS Signature for unhandled type %T seen", t)
+			i = []byte(r.String())
 		}
+		rdata = append(rdata, string(i))
+	}
+	sort.Strings(rdata)
+	for _, i := range rdata {
+		h.Write(packUint16(uint16(len(i))))
+		h.Write([]byte(i))
 	}
-	return string(h.Sum(i))
+	return string(h.Sum(nil))
 }
 
 // TODO(miek): prolly should use the stdlib ones
@@ -0,0 +1,129 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const dohMediaType = "application/dns-message"
+
+// dohWriter is the dns.ResponseWriter for DNS-over-HTTPS, it keeps the reply
+// so it can be written as the HTTP response.
+type dohWriter struct {
+	local, remote net.Addr
+	msg           *dns.Msg
+	raw           []byte
+}
+
+func (w *dohWriter) LocalAddr() net.Addr  { return w.local }
+func (w *dohWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *dohWriter) TsigStatus() error    { return nil }
+func (w *dohWriter) TsigTimersOnly(bool)  {}
+func (w *dohWriter) Hijack()              {}
+func (w *dohWriter) Close() error         { return nil }
+
+func (w *dohWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *dohWriter) Write(b []byte) (int, error) {
+	w.raw = append([]byte(nil), b...)
+	return len(b), nil
+}
+
+// tcpAddr returns addr, as host:port, as a TCP address. DNS-over-HTTPS is
+// handled like DNS over TCP, so replies are never truncated.
+func tcpAddr(addr string) net.Addr {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	p, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+}
+
+// Handle DNS-over-HTTPS (RFC 8484) requests, the query is either the base64url
+// encoded dns parameter of a GET or the body of a POST. It is answered by
+// ServeDNS, like the queries on the DNS port.
+func (s *Server) dnsQueryHTTPHandler(w http.ResponseWriter, req *http.Request) {
+	var (
+		buf []byte
+		err error
+	)
+	switch req.Method {
+	case "GET":
+		// base64url without padding, but accept it with padding
+		buf, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(req.URL.Query().Get("dns"), "="))
+	case "POST":
+		if req.Header.Get("Content-Type") != dohMediaType {
+			http.Error(w, "Content-Type must be "+dohMediaType, http.StatusUnsupportedMediaType)
+			return
+		}
+		buf, err = ioutil.ReadAll(io.LimitReader(req.Body, dns.MaxMsgSize))
+	}
+	if err != nil || len(buf) == 0 {
+		http.Error(w, "DNS query required", http.StatusBadRequest)
+		return
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(buf); err != nil || len(m.Question) != 1 {
+		http.Error(w, "Invalid DNS query", http.StatusBadRequest)
+		return
+	}
+
+	dw := &dohWriter{local: tcpAddr(s.httpAddr), remote: tcpAddr(req.RemoteAddr)}
+	if m.Question[0].Qtype == dns.TypeAXFR || m.Question[0].Qtype == dns.TypeIXFR {
+		// A zone transfer can take more than one message
+		r := new(dns.Msg)
+		r.SetRcode(m, dns.RcodeRefused)
+		dw.WriteMsg(r)
+	} else {
+		s.ServeDNS(dw, m)
+	}
+
+	out := dw.raw
+	if dw.msg != nil {
+		if out, err = dw.msg.Pack(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(minTTL(dw.msg))))
+	}
+	if out == nil {
+		http.Error(w, "No reply", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", dohMediaType)
+	w.Write(out)
+}
+
+// minTTL returns the lowest TTL in m, which is how long the HTTP response may
+// be cached, RFC 8484 section 5.1.
+func minTTL(m *dns.Msg) uint32 {
+	var ttl uint32
+	first := true
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, r := range section {
+			if r.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if first || r.Header().Ttl < ttl {
+				ttl = r.Header().Ttl
+				first = false
+			}
+		}
+	}
+	return ttl
+}
@@ -6,9 +6,11 @@ package server
 
 import (
 	"encoding/json"
+	"github.com/skynetservices/skydns1/msg"
 	"github.com/skynetservices/skydns1/registry"
 	"log"
 	"net/http"
+	"strings"
 )
 
 func (s *Server) getRegionsHTTPHandler(w http.ResponseWriter, req *http.Request) {
@@ -82,6 +84,12 @@ func (s *Server) getServicesHTTPHandler(w http.ResponseWriter, req *http.Request
 	log.Println("Retrieving All Services for query", q)
 
 	srv, err := s.registry.Get(q)
+	if err == nil {
+		srv = filterMetadata(srv, req)
+		if len(srv) == 0 {
+			err = registry.ErrNotExists
+		}
+	}
 
 	if err != nil {
 		switch err {
@@ -99,3 +107,29 @@ func (s *Server) getServicesHTTPHandler(w http.ResponseWriter, req *http.Request
 		log.Println("Error: ", err)
 	}
 }
+
+// filterMetadata only keeps the services that have all metadata given as
+// meta.<key>=<value> query parameters, i.e. ?meta.protocol=http.
+func filterMetadata(services []msg.Service, req *http.Request) []msg.Service {
+	filter := make(map[string]string)
+	for k, v := range req.URL.Query() {
+		if strings.HasPrefix(k, "meta.") && len(v) > 0 {
+			filter[k[len("meta."):]] = v[0]
+		}
+	}
+	if len(filter) == 0 {
+		return services
+	}
+
+	matched := make([]msg.Service, 0, len(services))
+Services:
+	for _, serv := range services {
+		for k, v := range filter {
+			if !serv.HasMetadata(k, v) {
+				continue Services
+			}
+		}
+		matched = append(matched, serv)
+	}
+	return matched
+}
@@ -0,0 +1,401 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"container/list"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns1/stats"
+)
+
+const (
+	forwardTimeout   = 2 * time.Second  // wait for a nameserver to reply
+	forwardBackoff   = 30 * time.Second // maximum time a failing nameserver is avoided
+	forwardCacheSize = 10000            // default number of cached replies
+	maxCacheTTL      = 3600             // cached replies expire after at most this many seconds
+)
+
+// upstream is a nameserver we forward to.
+type upstream struct {
+	sync.Mutex
+	addr     string
+	rtt      time.Duration // smoothed round trip time, 0 until it replied
+	failures int           // consecutive failures
+	down     time.Time     // avoided until this time
+}
+
+// success records a reply from the nameserver after rtt.
+func (u *upstream) success(rtt time.Duration) {
+	u.Lock()
+	defer u.Unlock()
+	u.failures = 0
+	u.down = time.Time{}
+	if u.rtt == 0 {
+		u.rtt = rtt
+		return
+	}
+	u.rtt = (7*u.rtt + rtt) / 8
+}
+
+// failure records that the nameserver did not reply, it is avoided for a time
+// that doubles with every consecutive failure.
+func (u *upstream) failure() {
+	u.Lock()
+	defer u.Unlock()
+	u.failures++
+	backoff := forwardBackoff
+	if u.failures < 6 {
+		backoff = time.Second << uint(u.failures-1)
+	}
+	u.down = time.Now().Add(backoff)
+
+	stats.ForwardFailedCount.Inc(1)
+	stats.UpstreamFailedCount(u.addr).Inc(1)
+}
+
+// upstreamState is a snapshot of the health of an upstream, used for sorting.
+type upstreamState struct {
+	u   *upstream
+	up  bool
+	rtt time.Duration
+}
+
+type byHealth []upstreamState
+
+// Healthy nameservers first, then the fastest
+func (p byHealth) Len() int { return len(p) }
+func (p byHealth) Less(i, j int) bool {
+	if p[i].up != p[j].up {
+		return p[i].up
+	}
+	return p[i].rtt < p[j].rtt
+}
+func (p byHealth) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+// forwarder forwards queries to the nameservers, preferring the healthy and
+// fast ones, and caches the replies.
+type forwarder struct {
+	upstreams []*upstream
+	race      bool      // query the two best nameservers at the same time
+	cache     *dnsCache // nil when caching is disabled
+}
+
+func newForwarder(nameservers []string) *forwarder {
+	f := &forwarder{cache: newDNSCache(forwardCacheSize)}
+	for _, ns := range nameservers {
+		f.upstreams = append(f.upstreams, &upstream{addr: ns})
+	}
+	return f
+}
+
+// SetForwarding sets how queries are forwarded to the nameservers. With race
+// every query is sent to the two best nameservers at the same time and the
+// first reply is used. Up to cacheSize replies are cached, 0 disables caching.
+func (s *Server) SetForwarding(race bool, cacheSize int) {
+	s.forwarder.race = race
+	s.forwarder.cache = nil
+	if cacheSize > 0 {
+		s.forwarder.cache = newDNSCache(cacheSize)
+	}
+
+	s.stubs.Lock()
+	defer s.stubs.Unlock()
+	for _, f := range s.stubs.forwarders {
+		f.race, f.cache = s.forwarder.race, s.forwarder.cache
+	}
+}
+
+// SetRecursion allows only the clients in nets to use SkyDNS as a recursive
+// nameserver, other clients get REFUSED for names outside our domain and the
+// hostnames of services outside our domain are not resolved for them. Without
+// networks every client may recurse.
+func (s *Server) SetRecursion(nets []*net.IPNet) {
+	s.recursionNets = nets
+}
+
+// recursionAllowed returns true if the client at w may recurse. The address
+// of the connection is used, never the EDNS0 Client Subnet, which is easily
+// spoofed.
+func (s *Server) recursionAllowed(w dns.ResponseWriter) bool {
+	if s.recursionNets == nil {
+		return true
+	}
+	var ip net.IP
+	switch a := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	}
+	for _, n := range s.recursionNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the CNAME, A and AAAA records the nameservers have for name
+// and qtype, nil when they have none or do not reply.
+func (s *Server) lookup(name string, qtype uint16) []dns.RR {
+	f := s.forwarderFor(name)
+	if len(f.upstreams) == 0 {
+		return nil
+	}
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+
+	key := cacheKey(req)
+	var r *dns.Msg
+	if f.cache != nil {
+		if r = f.cache.get(key); r != nil {
+			stats.ForwardCacheHitCount.Inc(1)
+		} else {
+			stats.ForwardCacheMissCount.Inc(1)
+		}
+	}
+	if r == nil {
+		var err error
+		if r, err = f.exchange(req, "udp"); err == nil && r.Truncated {
+			r, err = f.exchange(req, "tcp")
+		}
+		if err != nil {
+			log.Printf("Error: Failure to resolve %q: %q", name, err)
+			return nil
+		}
+		if f.cache != nil {
+			f.cache.add(key, r)
+		}
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+
+	var records []dns.RR
+	for _, rr := range r.Answer {
+		switch rr.Header().Rrtype {
+		case dns.TypeCNAME, dns.TypeA, dns.TypeAAAA:
+			records = append(records, rr)
+		}
+	}
+	return records
+}
+
+// ordered returns the nameservers, the healthy ones first and the fastest
+// of those first. Nameservers that did not reply yet count as fastest, so
+// they get a chance.
+func (f *forwarder) ordered() []*upstream {
+	now := time.Now()
+	states := make(byHealth, 0, len(f.upstreams))
+	for _, u := range f.upstreams {
+		u.Lock()
+		states = append(states, upstreamState{u, now.After(u.down), u.rtt})
+		u.Unlock()
+	}
+	sort.Stable(states)
+	upstreams := make([]*upstream, 0, len(states))
+	for _, st := range states {
+		upstreams = append(upstreams, st.u)
+	}
+	return upstreams
+}
+
+// exchange sends req to the nameservers, best first, until one replies.
+func (f *forwarder) exchange(req *dns.Msg, network string) (*dns.Msg, error) {
+	upstreams := f.ordered()
+	var err error
+	if f.race && len(upstreams) > 1 {
+		var r *dns.Msg
+		if r, err = f.race2(req, network, upstreams[0], upstreams[1]); err == nil {
+			return r, nil
+		}
+		upstreams = upstreams[2:]
+	}
+	for _, u := range upstreams {
+		var r *dns.Msg
+		if r, err = f.query(req, network, u); err == nil {
+			return r, nil
+		}
+	}
+	return nil, err
+}
+
+// race2 sends req to a and b at the same time and returns the first reply.
+func (f *forwarder) race2(req *dns.Msg, network string, a, b *upstream) (*dns.Msg, error) {
+	type reply struct {
+		r   *dns.Msg
+		err error
+	}
+	replies := make(chan reply, 2)
+	for _, u := range []*upstream{a, b} {
+		go func(u *upstream, req *dns.Msg) {
+			r, err := f.query(req, network, u)
+			replies <- reply{r, err}
+		}(u, req.Copy())
+	}
+	var err error
+	for i := 0; i < 2; i++ {
+		rep := <-replies
+		if rep.err == nil {
+			return rep.r, nil
+		}
+		err = rep.err
+	}
+	return nil, err
+}
+
+// query sends req to nameserver u and records the outcome.
+func (f *forwarder) query(req *dns.Msg, network string, u *upstream) (*dns.Msg, error) {
+	c := &dns.Client{Net: network, ReadTimeout: forwardTimeout}
+	r, rtt, err := c.Exchange(req, u.addr)
+	if err != nil {
+		log.Printf("Error: Failure to Forward DNS Request %q to %q", err, u.addr)
+		u.failure()
+		return nil, err
+	}
+	u.success(rtt)
+	log.Printf("Forwarded DNS Request %q to %q", req.Question[0].Name, u.addr)
+	return r, nil
+}
+
+// dnsCache is a cache of forwarded replies, when it is full the least recently
+// used reply is removed.
+type dnsCache struct {
+	sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List // of *cacheEntry, most recently used first
+}
+
+type cacheEntry struct {
+	key     string
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+func newDNSCache(size int) *dnsCache {
+	return &dnsCache{size: size, entries: make(map[string]*list.Element), lru: list.New()}
+}
+
+// cacheKey returns the key under which the reply to req is cached.
+func cacheKey(req *dns.Msg) string {
+	q := req.Question[0]
+	key := strings.ToLower(q.Name) + "/" + strconv.Itoa(int(q.Qtype)) + "/" + strconv.Itoa(int(q.Qclass))
+	if opt := req.IsEdns0(); opt != nil && opt.Do() {
+		key += "/do"
+	}
+	if req.CheckingDisabled {
+		key += "/cd"
+	}
+	return key
+}
+
+// get returns a copy of the reply cached under key, with the TTLs lowered by
+// the time it has been in the cache, or nil.
+func (c *dnsCache) get(key string) *dns.Msg {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := e.Value.(*cacheEntry)
+	now := time.Now()
+	if !now.Before(entry.expires) {
+		c.lru.Remove(e)
+		delete(c.entries, key)
+		return nil
+	}
+	c.lru.MoveToFront(e)
+
+	m := entry.msg.Copy()
+	age := uint32(now.Sub(entry.stored) / time.Second)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, r := range section {
+			if r.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if r.Header().Ttl > age {
+				r.Header().Ttl -= age
+			} else {
+				r.Header().Ttl = 0
+			}
+		}
+	}
+	return m
+}
+
+// add caches reply m under key, if it can be cached.
+func (c *dnsCache) add(key string, m *dns.Msg) {
+	ttl := cacheTTL(m)
+	if ttl == 0 {
+		return
+	}
+	now := time.Now()
+	entry := &cacheEntry{key: key, msg: m.Copy(), stored: now, expires: now.Add(time.Duration(ttl) * time.Second)}
+
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value = entry
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.entries, e.Value.(*cacheEntry).key)
+	}
+}
+
+// cacheTTL returns how long reply m may be cached, 0 if it may not. Positive
+// replies are cached for their lowest TTL, negative replies (NXDOMAIN and
+// NODATA) for the minimum TTL of the SOA in the authority section, RFC 2308.
+func cacheTTL(m *dns.Msg) uint32 {
+	if m.Truncated {
+		return 0
+	}
+	ttl := uint32(maxCacheTTL)
+	switch {
+	case m.Rcode == dns.RcodeSuccess && len(m.Answer) > 0:
+		for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+			for _, r := range section {
+				if r.Header().Rrtype != dns.TypeOPT && r.Header().Ttl < ttl {
+					ttl = r.Header().Ttl
+				}
+			}
+		}
+	case m.Rcode == dns.RcodeSuccess || m.Rcode == dns.RcodeNameError:
+		var soa *dns.SOA
+		for _, r := range m.Ns {
+			if s, ok := r.(*dns.SOA); ok {
+				soa = s
+				break
+			}
+		}
+		if soa == nil {
+			return 0
+		}
+		if soa.Hdr.Ttl < ttl {
+			ttl = soa.Hdr.Ttl
+		}
+		if soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+	default:
+		return 0
+	}
+	return ttl
+}
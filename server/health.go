@@ -0,0 +1,247 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/goraft/raft"
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns1/msg"
+	"github.com/skynetservices/skydns1/stats"
+)
+
+// Defaults for the health checks, see msg.Check.
+const (
+	checkInterval = 10
+	checkTimeout  = 5
+	checkFall     = 3
+	checkRise     = 2
+	checkStatus   = http.StatusOK
+
+	maxChecks = 64 // maximum number of checks running at the same time
+)
+
+var errCheckType = errors.New("Unknown health check type")
+
+// checker runs the health checks of the services, only the leader does this.
+type checker struct {
+	sync.Mutex
+	states  map[string]*checkState // by UUID
+	running chan bool              // limits the number of running checks
+}
+
+type checkState struct {
+	next      time.Time // time of the next check
+	running   bool
+	successes int // consecutive
+	failures  int // consecutive
+}
+
+func newChecker() *checker {
+	return &checker{
+		states:  make(map[string]*checkState),
+		running: make(chan bool, maxChecks),
+	}
+}
+
+// reset forgets all check results, this is done when we lose leadership.
+func (c *checker) reset() {
+	c.Lock()
+	defer c.Unlock()
+	c.states = make(map[string]*checkState)
+}
+
+// validateCheck checks the health check of a new service.
+func validateCheck(c *msg.Check) error {
+	if c == nil {
+		return nil
+	}
+	switch c.Type {
+	case msg.CheckTCP, msg.CheckHTTP, msg.CheckDNS:
+		return nil
+	}
+	return errCheckType
+}
+
+// checkHealth starts the health checks that are due.
+func (s *Server) checkHealth() {
+	services, _ := s.registry.Get("*")
+	now := time.Now()
+
+	s.checker.Lock()
+	defer s.checker.Unlock()
+
+	seen := make(map[string]bool, len(services))
+	for _, serv := range services {
+		if serv.Check == nil {
+			continue
+		}
+		seen[serv.UUID] = true
+
+		st, ok := s.checker.states[serv.UUID]
+		if !ok {
+			st = &checkState{next: now}
+			s.checker.states[serv.UUID] = st
+		}
+		if st.running || now.Before(st.next) {
+			continue
+		}
+		select {
+		case s.checker.running <- true:
+		default:
+			// Too many checks running, try again on the next tick
+			return
+		}
+		st.running = true
+		go func(serv msg.Service) {
+			err := runCheck(serv)
+			<-s.checker.running
+			s.checkResult(serv, err)
+		}(serv)
+	}
+	// Forget the services that are gone
+	for uuid, st := range s.checker.states {
+		if !seen[uuid] && !st.running {
+			delete(s.checker.states, uuid)
+		}
+	}
+}
+
+// checkResult records the result of a check and changes the health of the
+// service when the thresholds are crossed.
+func (s *Server) checkResult(serv msg.Service, err error) {
+	// The health may have changed while the check was running
+	serv, e := s.registry.Lookup(serv.UUID)
+	if e != nil || serv.Check == nil {
+		return
+	}
+	c := serv.Check
+	fall, rise, interval := checkFall, checkRise, uint32(checkInterval)
+	if c.Fall > 0 {
+		fall = c.Fall
+	}
+	if c.Rise > 0 {
+		rise = c.Rise
+	}
+	if c.Interval > 0 {
+		interval = c.Interval
+	}
+
+	s.checker.Lock()
+	st, ok := s.checker.states[serv.UUID]
+	if !ok {
+		s.checker.Unlock()
+		return
+	}
+	st.running = false
+	st.next = time.Now().Add(time.Duration(interval) * time.Second)
+	if err == nil {
+		st.successes++
+		st.failures = 0
+	} else {
+		st.failures++
+		st.successes = 0
+	}
+	successes, failures := st.successes, st.failures
+	s.checker.Unlock()
+
+	var command raft.Command
+	switch {
+	case !serv.Unhealthy() && failures >= fall:
+		stats.CheckFailedCount.Inc(1)
+		log.Printf("Health check of service %s failed: %s", serv.UUID, err)
+		if c.Deregister {
+			command = NewRemoveServiceCommand(serv.UUID)
+		} else {
+			command = NewSetHealthCommand(serv.UUID, msg.Health{Healthy: false, Output: err.Error(), Since: time.Now()})
+		}
+	case serv.Unhealthy() && successes >= rise:
+		log.Printf("Health check of service %s passed", serv.UUID)
+		command = NewSetHealthCommand(serv.UUID, msg.Health{Healthy: true, Output: "OK", Since: time.Now()})
+	default:
+		return
+	}
+	if _, err := s.raftServer.Do(command); err != nil {
+		log.Println("Error: failed to change the health of service", serv.UUID, err)
+	}
+}
+
+// runCheck performs the health check of service serv.
+func runCheck(serv msg.Service) error {
+	c := serv.Check
+	target := c.Target
+	if target == "" {
+		target = net.JoinHostPort(serv.Host, strconv.Itoa(int(serv.Port)))
+	}
+	timeout := time.Duration(checkTimeout) * time.Second
+	if c.Timeout > 0 {
+		timeout = time.Duration(c.Timeout) * time.Second
+	}
+
+	switch c.Type {
+	case msg.CheckTCP:
+		conn, err := net.DialTimeout("tcp", target, timeout)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+		return nil
+	case msg.CheckHTTP:
+		path, status := c.Path, c.Status
+		if path == "" {
+			path = "/"
+		}
+		if status == 0 {
+			status = checkStatus
+		}
+		client := &http.Client{Timeout: timeout}
+		resp, err := client.Get("http://" + target + path)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			return fmt.Errorf("HTTP status %d, expected %d", resp.StatusCode, status)
+		}
+		return nil
+	case msg.CheckDNS:
+		question := c.Question
+		if question == "" {
+			question = "."
+		}
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(question), dns.TypeNS)
+		client := &dns.Client{ReadTimeout: timeout}
+		r, _, err := client.Exchange(m, target)
+		if err != nil {
+			return err
+		}
+		if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+			return fmt.Errorf("DNS rcode %s", dns.RcodeToString[r.Rcode])
+		}
+		return nil
+	}
+	return errCheckType
+}
+
+// healthy returns the services that have not failed their health check.
+func healthy(services []msg.Service) []msg.Service {
+	j := 0
+	for _, serv := range services {
+		if !serv.Unhealthy() {
+			services[j] = serv
+			j++
+		}
+	}
+	return services[:j]
+}
@@ -0,0 +1,270 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns1/msg"
+)
+
+const keyCheckInterval = 1 * time.Minute // how often the leader checks if the keys must change
+
+var ErrKeyAlgorithm = errors.New("DNSSEC key algorithm must be RSASHA256, ECDSAP256SHA256 or ED25519")
+
+// keyAlgorithms are the algorithms SkyDNS generates keys for.
+var keyAlgorithms = map[string]uint8{
+	"RSASHA256":       dns.RSASHA256,
+	"ECDSAP256SHA256": dns.ECDSAP256SHA256,
+	"ED25519":         dns.ED25519,
+}
+
+// keyManager generates the DNSSEC keys and rolls the zone signing key over,
+// the keys themselves are stored in the registry.
+type keyManager struct {
+	sync.Mutex
+	algorithm  uint8
+	lifetime   time.Duration          // a ZSK is replaced after signing this long, 0 never
+	prepublish time.Duration          // a new ZSK is published this long before it signs
+	checked    time.Time              // when the leader last checked the keys
+	parsed     map[string]*signingKey // by DNSKEY, parsing a private key is expensive
+}
+
+// signingKey is a parsed DNSSEC key.
+type signingKey struct {
+	dnskey  *dns.DNSKEY
+	tag     uint16
+	private dns.PrivateKey
+}
+
+// zoneKeys are the DNSSEC keys in use at a moment.
+type zoneKeys struct {
+	published []*dns.DNSKEY // the DNSKEY RRset
+	ksk       []*signingKey // sign the DNSKEY RRset
+	zsk       []*signingKey // sign all other RRsets
+}
+
+// SetKeyManagement makes SkyDNS generate its own DNSSEC keys with algorithm
+// (RSASHA256, ECDSAP256SHA256 or ED25519): a key signing key and a zone signing
+// key. The keys are replicated to all members. The zone signing key is replaced
+// after lifetime, the new key is published prepublish before it is used for
+// signing and the old one is removed prepublish after it was last used. A
+// lifetime of 0 never replaces the key. The key signing key is never replaced,
+// that needs the parent zone. This replaces keys given with SetKeys.
+func (s *Server) SetKeyManagement(algorithm string, lifetime, prepublish time.Duration) error {
+	alg, ok := keyAlgorithms[strings.ToUpper(algorithm)]
+	if !ok {
+		return ErrKeyAlgorithm
+	}
+	s.keys = &keyManager{algorithm: alg, lifetime: lifetime, prepublish: prepublish, parsed: make(map[string]*signingKey)}
+	s.registry.DNSSEC(true)
+	return nil
+}
+
+// zoneKeys returns the keys to use at time t, or nil when replies are not
+// signed. Without a separate KSK or ZSK a single key signs everything.
+func (s *Server) zoneKeys(t time.Time) *zoneKeys {
+	if s.keys == nil {
+		if s.dnsKey == nil {
+			return nil
+		}
+		k := &signingKey{s.dnsKey, s.keyTag, s.privKey}
+		return &zoneKeys{published: []*dns.DNSKEY{s.dnsKey}, ksk: []*signingKey{k}, zsk: []*signingKey{k}}
+	}
+
+	zk := new(zoneKeys)
+	for _, key := range s.registry.Keys() {
+		k, err := s.keys.parse(key)
+		if err != nil {
+			log.Println("Error: invalid DNSSEC key:", err)
+			continue
+		}
+		if key.IsPublished(t) {
+			zk.published = append(zk.published, k.dnskey)
+		}
+		if !key.IsActive(t) {
+			continue
+		}
+		if key.KSK {
+			zk.ksk = append(zk.ksk, k)
+		} else {
+			zk.zsk = append(zk.zsk, k)
+		}
+	}
+	if len(zk.ksk) == 0 {
+		zk.ksk = zk.zsk
+	}
+	if len(zk.zsk) == 0 {
+		zk.zsk = zk.ksk
+	}
+	if len(zk.zsk) == 0 {
+		return nil
+	}
+	return zk
+}
+
+// parse returns key parsed.
+func (km *keyManager) parse(key msg.Key) (*signingKey, error) {
+	km.Lock()
+	defer km.Unlock()
+	if k, ok := km.parsed[key.DNSKEY]; ok {
+		return k, nil
+	}
+	rr, err := dns.NewRR(key.DNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	dnskey, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, errors.New("not a DNSKEY: " + key.DNSKEY)
+	}
+	p, err := dnskey.NewPrivateKey(key.Private)
+	if err != nil {
+		return nil, err
+	}
+	k := &signingKey{dnskey: dnskey, tag: dnskey.KeyTag(), private: p}
+	km.parsed[key.DNSKEY] = k
+	return k, nil
+}
+
+// manageKeys is run by the leader, it generates the missing keys, starts ZSK
+// rollovers and removes the keys that are no longer published.
+func (s *Server) manageKeys() {
+	if s.keys == nil || time.Since(s.keys.checked) < keyCheckInterval {
+		return
+	}
+	s.keys.checked = time.Now()
+
+	keys, changed, err := s.rollKeys(s.registry.Keys(), time.Now().UTC())
+	if err != nil {
+		log.Println("Error: failed to generate DNSSEC key:", err)
+		return
+	}
+	if !changed {
+		return
+	}
+	if _, err := s.raftServer.Do(NewSetKeysCommand(keys)); err != nil {
+		log.Println("Error: failed to store DNSSEC keys:", err)
+	}
+}
+
+// rollKeys returns the keys as they should be at time now, and true if they
+// differ from keys.
+//
+// A ZSK rollover uses pre-publication, RFC 6781 section 4.1.1.1: the new ZSK is
+// published first and only signs once resolvers have seen it. At that moment
+// the old ZSK stops signing, it stays published until the signatures it made
+// have expired from the caches.
+func (s *Server) rollKeys(keys []msg.Key, now time.Time) ([]msg.Key, bool, error) {
+	var (
+		next    []msg.Key
+		changed bool
+		ksk     bool
+		zsk     = -1 // index in next of the ZSK that is not retired
+	)
+	for _, k := range keys {
+		if !k.Removed.IsZero() && !now.Before(k.Removed) {
+			changed = true
+			continue
+		}
+		switch {
+		case k.KSK && k.Retired.IsZero():
+			ksk = true
+		case !k.KSK && k.Retired.IsZero():
+			zsk = len(next)
+		}
+		next = append(next, k)
+	}
+
+	if !ksk {
+		k, err := s.newKey(true, now, now)
+		if err != nil {
+			return nil, false, err
+		}
+		next = append(next, k)
+		changed = true
+	}
+	if zsk < 0 {
+		k, err := s.newKey(false, now, now)
+		if err != nil {
+			return nil, false, err
+		}
+		next = append(next, k)
+		return next, true, nil
+	}
+
+	old := &next[zsk]
+	if s.keys.lifetime == 0 || now.Before(old.Active.Add(s.keys.lifetime)) {
+		return next, changed, nil
+	}
+	active := now.Add(s.keys.prepublish)
+	k, err := s.newKey(false, now, active)
+	if err != nil {
+		return nil, false, err
+	}
+	old.Retired = active
+	old.Removed = active.Add(s.keys.prepublish)
+	log.Printf("Starting ZSK rollover, the new key signs from %s", active)
+	return append(next, k), true, nil
+}
+
+// newKey generates a new key for the domain, published at published and
+// signing from active.
+func (s *Server) newKey(ksk bool, published, active time.Time) (msg.Key, error) {
+	k := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: dns.Fqdn(s.domain), Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: origTTL},
+		Flags:     256, // zone key
+		Protocol:  3,
+		Algorithm: s.keys.algorithm,
+	}
+	if ksk {
+		k.Flags |= 1 // SEP
+	}
+	bits := 256
+	if k.Algorithm == dns.RSASHA256 {
+		bits = 2048
+	}
+	p, err := k.Generate(bits)
+	if err != nil {
+		return msg.Key{}, err
+	}
+	log.Printf("Generated DNSSEC key %d, KSK: %t", k.KeyTag(), ksk)
+	return msg.Key{DNSKEY: k.String(), Private: k.PrivateKeyString(p), KSK: ksk, Published: published, Active: active}, nil
+}
+
+// Handle API requests for the DNSKEY RRset and the DS, CDS and CDNSKEY records
+// of the key signing keys, the latter are for the parent zone.
+func (s *Server) getKeysHTTPHandler(w http.ResponseWriter, req *http.Request) {
+	var reply struct {
+		DNSKEY  []string
+		DS      []string
+		CDS     []string
+		CDNSKEY []string
+	}
+	now := time.Now().UTC()
+	if keys := s.zoneKeys(now); keys != nil {
+		for _, k := range keys.published {
+			reply.DNSKEY = append(reply.DNSKEY, k.String())
+		}
+		for _, k := range keys.ksk {
+			ds := k.dnskey.ToDS(dns.SHA256)
+			reply.DS = append(reply.DS, ds.String())
+			reply.CDS = append(reply.CDS, ds.ToCDS().String())
+			reply.CDNSKEY = append(reply.CDNSKEY, k.dnskey.ToCDNSKEY().String())
+		}
+	}
+
+	if err := json.NewEncoder(w).Encode(reply); err != nil {
+		log.Println("Error: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/goraft/raft"
+	"github.com/gorilla/mux"
+	"github.com/skynetservices/skydns1/msg"
+)
+
+// Load reports older than this are ignored.
+const loadTimeout = 60 * time.Second
+
+// SetLoadTimeout sets the time after which a load report is considered stale.
+func (s *Server) SetLoadTimeout(d time.Duration) {
+	s.loadTimeout = d
+}
+
+// weights returns the SRV weight of each service (by UUID). The weights are
+// divided according to the headroom in the load reports of the hosts of the
+// services, so idle hosts get a larger share. Services without a recent load
+// report get the average headroom of the others, without any recent reports
+// the weight is divided equally.
+func (s *Server) weights(services []msg.Service) map[string]uint16 {
+	weights := make(map[string]uint16, len(services))
+	if len(services) == 0 {
+		return weights
+	}
+
+	loads := s.registry.Loads()
+	now := time.Now()
+	headroom := make(map[string]float64, len(services))
+	total, reported := 0.0, 0
+	for _, serv := range services {
+		l, ok := loads[strings.ToLower(serv.Host)]
+		if !ok || now.Sub(l.Reported) > s.loadTimeout {
+			continue
+		}
+		headroom[serv.UUID] = l.Headroom()
+		total += headroom[serv.UUID]
+		reported++
+	}
+
+	if reported == 0 || total == 0 {
+		return equalWeights(services)
+	}
+
+	average := total / float64(reported)
+	for _, serv := range services {
+		if _, ok := headroom[serv.UUID]; !ok {
+			headroom[serv.UUID] = average
+			total += average
+		}
+	}
+	for _, serv := range services {
+		weight := uint16(math.Floor(100*headroom[serv.UUID]/total + 0.5))
+		if weight == 0 {
+			// Weight 0 has a special meaning, see RFC 2782
+			weight = 1
+		}
+		weights[serv.UUID] = weight
+	}
+	return weights
+}
+
+// equalWeights returns the SRV weight of each service (by UUID) with the
+// weight divided equally.
+func equalWeights(services []msg.Service) map[string]uint16 {
+	weights := make(map[string]uint16, len(services))
+	if len(services) == 0 {
+		return weights
+	}
+	weight := uint16(math.Floor(float64(100 / len(services))))
+	for _, serv := range services {
+		weights[serv.UUID] = weight
+	}
+	return weights
+}
+
+// Handle API load report requests.
+func (s *Server) setLoadHTTPHandler(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	var host string
+	var ok bool
+
+	if host, ok = vars["host"]; !ok {
+		http.Error(w, "Host required", http.StatusBadRequest)
+		return
+	}
+
+	var l msg.Load
+	if err := json.NewDecoder(req.Body).Decode(&l); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := l.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := s.raftServer.Do(NewSetLoadCommand(host, l)); err != nil {
+		switch err {
+		case raft.NotLeaderError:
+			s.redirectToLeader(w, req)
+		default:
+			log.Println("Error: ", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// Handle API requests for all load reports.
+func (s *Server) getLoadsHTTPHandler(w http.ResponseWriter, req *http.Request) {
+	if err := json.NewEncoder(w).Encode(s.registry.Loads()); err != nil {
+		log.Println("Error: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
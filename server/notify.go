@@ -0,0 +1,70 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"log"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	notifyDelay    = 1 * time.Second // changes within this time result in a single NOTIFY
+	notifyAttempts = 3               // attempts before we give up on a secondary
+	notifyTimeout  = 2 * time.Second // wait for the reply to a NOTIFY
+)
+
+// SetNotify sets the secondaries (as ip:port) that get a DNS NOTIFY when the
+// zone changes. Only the leader sends them.
+func (s *Server) SetNotify(secondaries []string) {
+	s.secondaries = secondaries
+}
+
+// notify tells the secondaries that the zone has changed, it never blocks.
+func (s *Server) notify() {
+	if len(s.secondaries) == 0 || !s.IsLeader() {
+		return
+	}
+	select {
+	case s.notifyPending <- true:
+	default:
+		// a NOTIFY is already pending
+	}
+}
+
+// notifyLoop sends the pending NOTIFY messages.
+func (s *Server) notifyLoop() {
+	for range s.notifyPending {
+		// Wait a bit, so a burst of changes results in one NOTIFY
+		time.Sleep(notifyDelay)
+		soa := s.createSOA()
+		for _, addr := range s.secondaries {
+			go s.sendNotify(addr, soa)
+		}
+	}
+}
+
+// sendNotify sends a NOTIFY with the SOA soa to the secondary at addr.
+func (s *Server) sendNotify(addr string, soa []dns.RR) {
+	m := new(dns.Msg)
+	m.SetNotify(dns.Fqdn(s.domain))
+	m.Answer = soa
+
+	c := &dns.Client{ReadTimeout: notifyTimeout}
+	var err error
+	for i := 0; i < notifyAttempts; i++ {
+		var r *dns.Msg
+		if r, _, err = c.Exchange(m, addr); err == nil {
+			if r.Rcode == dns.RcodeSuccess {
+				log.Printf("Sent NOTIFY with serial %d to %q", soa[0].(*dns.SOA).Serial, addr)
+				return
+			}
+			log.Printf("Error: NOTIFY to %q returned %s", addr, dns.RcodeToString[r.Rcode])
+			return
+		}
+	}
+	log.Printf("Error: failed to send NOTIFY to %q: %s", addr, err)
+}
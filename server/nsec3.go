@@ -0,0 +1,117 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// nsec3 adds the NSEC3 records that prove the denial of existence in m, see
+// RFC 5155, section 7.2.
+func (s *Server) nsec3(m *dns.Msg) {
+	qname := m.Question[0].Name
+	if m.Rcode == dns.RcodeNameError {
+		// closest encloser, next closer name and wildcard at the closest encloser
+		ce, nc := s.closestEncloser(qname)
+		s.addNSEC3(m, s.hashName(ce), s.hashName(nc), s.hashName("*."+ce))
+		return
+	}
+	if m.Rcode == dns.RcodeSuccess && len(m.Ns) == 1 {
+		if _, ok := m.Ns[0].(*dns.SOA); !ok {
+			return
+		}
+		// NODATA: the NSEC3 matching qname, without the type of the
+		// question, RFC 5155 section 7.2.3.
+		h := s.hashName(qname)
+		owner, next := s.registry.GetNSEC3(h)
+		if owner != h {
+			// qname exists but is not in the hashed names, e.g. a UUID or
+			// a wildcard pattern: an NSEC3 that only matches qname.
+			next = nextHash(h)
+		}
+		nsec3 := s.newNSEC3(h, next)
+		bitmap := make([]uint16, 0, len(nsec3.TypeBitMap))
+		for _, t := range nsec3.TypeBitMap {
+			if t != m.Question[0].Qtype {
+				bitmap = append(bitmap, t)
+			}
+		}
+		nsec3.TypeBitMap = bitmap
+		m.Ns = append(m.Ns, nsec3)
+	}
+}
+
+// nextHash returns the hash that follows the base32hex encoded hash h.
+func nextHash(h string) string {
+	const digits = "0123456789abcdefghijklmnopqrstuv"
+	b := []byte(h)
+	for i := len(b) - 1; i >= 0; i-- {
+		if j := strings.IndexByte(digits, b[i]); j < len(digits)-1 {
+			b[i] = digits[j+1]
+			return string(b)
+		}
+		b[i] = digits[0]
+	}
+	return string(b)
+}
+
+// closestEncloser returns the closest encloser of qname and the next closer
+// name, the name one label longer than the closest encloser.
+func (s *Server) closestEncloser(qname string) (string, string) {
+	apex := dns.Fqdn(s.domain)
+	idx := dns.Split(qname)
+	for i := 1; i < len(idx); i++ {
+		name := qname[idx[i]:]
+		if name == apex || !dns.IsSubDomain(apex, name) {
+			break
+		}
+		h := s.hashName(name)
+		if owner, _ := s.registry.GetNSEC3(h); owner == h {
+			return name, qname[idx[i-1]:]
+		}
+	}
+	// The apex always exists
+	labels := dns.CountLabel(qname) - s.domainLabels
+	if labels < 1 {
+		return apex, qname
+	}
+	return apex, qname[idx[labels-1]:]
+}
+
+// hashName returns the lowercase NSEC3 hash of name.
+func (s *Server) hashName(name string) string {
+	p := s.nsec3Param
+	return strings.ToLower(dns.HashName(name, p.Hash, p.Iterations, p.Salt))
+}
+
+// addNSEC3 adds the NSEC3 records that match or cover the hashes to the
+// authority section of m, each record is only added once.
+func (s *Server) addNSEC3(m *dns.Msg, hashes ...string) {
+	seen := make(map[string]bool)
+	for _, h := range hashes {
+		owner, next := s.registry.GetNSEC3(h)
+		if owner == "" || seen[owner] {
+			continue
+		}
+		seen[owner] = true
+		m.Ns = append(m.Ns, s.newNSEC3(owner, next))
+	}
+}
+
+// newNSEC3 returns the NSEC3 record for the hashed owner name.
+func (s *Server) newNSEC3(owner, next string) *dns.NSEC3 {
+	p := s.nsec3Param
+	nsec3 := &dns.NSEC3{Hdr: dns.RR_Header{Name: owner + "." + s.domain + ".", Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 60},
+		Hash: p.Hash, Iterations: p.Iterations, SaltLength: p.SaltLength, Salt: p.Salt,
+		HashLength: 20, NextDomain: strings.ToUpper(next)}
+	if owner == s.hashName(dns.Fqdn(s.domain)) {
+		nsec3.TypeBitMap = []uint16{dns.TypeA, dns.TypeNS, dns.TypeSOA, dns.TypeAAAA, dns.TypeRRSIG, dns.TypeDNSKEY, dns.TypeNSEC3PARAM}
+	} else {
+		nsec3.TypeBitMap = []uint16{dns.TypeA, dns.TypeTXT, dns.TypeAAAA, dns.TypeSRV, dns.TypeRRSIG}
+	}
+	return nsec3
+}
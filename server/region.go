@@ -0,0 +1,165 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns1/msg"
+)
+
+// regionNetwork maps the clients in a network to a region.
+type regionNetwork struct {
+	net    *net.IPNet
+	region string
+}
+
+type regionNetworks []regionNetwork
+
+// Most specific networks first
+func (p regionNetworks) Len() int { return len(p) }
+func (p regionNetworks) Less(i, j int) bool {
+	oi, _ := p[i].net.Mask.Size()
+	oj, _ := p[j].net.Mask.Size()
+	return oi > oj
+}
+func (p regionNetworks) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+// SetRegionNetworks sets the region of the clients in each network, given as
+// CIDR. Queries that do not name a region get the services in the region of
+// the client first, the most specific network containing the address from
+// the EDNS0 Client Subnet option or else the address of the client is used.
+func (s *Server) SetRegionNetworks(networks map[string]string) error {
+	nets := make(regionNetworks, 0, len(networks))
+	for cidr, region := range networks {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		nets = append(nets, regionNetwork{n, strings.ToLower(region)})
+	}
+	sort.Sort(nets)
+	s.regionNets = nets
+	return nil
+}
+
+// clientRegion returns the region of the client that sent req, or the empty
+// string when it is not known. When req has an EDNS0 Client Subnet option the
+// option for the reply is returned as well.
+func (s *Server) clientRegion(w dns.ResponseWriter, req *dns.Msg) (string, *dns.EDNS0_SUBNET) {
+	if len(s.regionNets) == 0 {
+		return "", nil
+	}
+	ip, subnet := clientAddress(w, req)
+	region := s.networkRegion(ip)
+	if subnet != nil {
+		// The answer depends on the subnet, also when it has no region:
+		// other subnets may have one. Only a region named in the query
+		// makes the answer the same for every client.
+		e := *subnet
+		e.SourceScope = e.SourceNetmask
+		if s.queryRegion(strings.ToLower(req.Question[0].Name)) != "" {
+			e.SourceScope = 0
+		}
+		subnet = &e
+	}
+	return region, subnet
+}
+
+// queryRegion returns the region named in name, the empty string when there is
+// none.
+func (s *Server) queryRegion(name string) string {
+	labels := dns.SplitDomainName(strings.TrimSuffix(name, s.domain+"."))
+	if pos := len(labels) - 4; pos >= 0 && labels[pos] != "*" {
+		return labels[pos]
+	}
+	return ""
+}
+
+// clientAddress returns the address of the client that sent req: the one in
+// the EDNS0 Client Subnet option and the option itself, or else the address
+// the query came from.
+func clientAddress(w dns.ResponseWriter, req *dns.Msg) (net.IP, *dns.EDNS0_SUBNET) {
+	if opt := req.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			// A source prefix length of 0 means the resolver does not
+			// want the client's address to be used, RFC 7871.
+			if e, ok := o.(*dns.EDNS0_SUBNET); ok && e.SourceNetmask > 0 {
+				return e.Address, e
+			}
+		}
+	}
+	switch a := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return a.IP, nil
+	case *net.TCPAddr:
+		return a.IP, nil
+	}
+	return nil, nil
+}
+
+// networkRegion returns the region of the most specific network containing ip.
+func (s *Server) networkRegion(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	for _, n := range s.regionNets {
+		if n.net.Contains(ip) {
+			return n.region
+		}
+	}
+	return ""
+}
+
+// setSubnet adds the EDNS0 Client Subnet option subnet to the reply m.
+func setSubnet(m *dns.Msg, subnet *dns.EDNS0_SUBNET) {
+	o := m.IsEdns0()
+	if o == nil {
+		o = new(dns.OPT)
+		o.Hdr.Name = "."
+		o.Hdr.Rrtype = dns.TypeOPT
+		o.SetUDPSize(4096)
+		m.Extra = append(m.Extra, o)
+	}
+	o.Option = append(o.Option, subnet)
+}
+
+// regionGroups divides services in groups by the region they are in, seen
+// from region: first the services in region itself (rank 0), then the regions
+// in the first tier of the topology (rank 1), etc. It returns the groups and
+// their ranks, without a region all services are in a single group.
+func (s *Server) regionGroups(region string, services []msg.Service) ([][]msg.Service, []int) {
+	if region == "" {
+		return [][]msg.Service{services}, []int{0}
+	}
+	regions := make([]string, 0, len(services))
+	for _, serv := range services {
+		regions = append(regions, serv.Region)
+	}
+	topology := s.registry.Topology()
+	tiers := topology.Tiers(region, regions)
+
+	byRank := make(map[int][]msg.Service)
+	for _, serv := range services {
+		rank := 0
+		if strings.ToLower(serv.Region) != region {
+			rank = tiers[serv.Region]
+		}
+		byRank[rank] = append(byRank[rank], serv)
+	}
+	ranks := make([]int, 0, len(byRank))
+	for r := range byRank {
+		ranks = append(ranks, r)
+	}
+	sort.Ints(ranks)
+	groups := make([][]msg.Service, 0, len(ranks))
+	for _, r := range ranks {
+		groups = append(groups, byRank[r])
+	}
+	return groups, ranks
+}
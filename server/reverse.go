@@ -0,0 +1,146 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"log"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns1/msg"
+)
+
+// SetReverse makes the server authoritative for the reverse zones, e.g.
+// "10.in-addr.arpa.". PTR queries in these zones are answered with the
+// UUID.skydns.local names of the services registered on the IP address, when
+// names is true the REGION.VERSION.SERVICE.ENVIRONMENT.skydns.local names of
+// these services are returned as well.
+func (s *Server) SetReverse(zones []string, names bool) {
+	s.reverseZones = make([]string, 0, len(zones))
+	for _, z := range zones {
+		s.reverseZones = append(s.reverseZones, dns.Fqdn(strings.ToLower(z)))
+	}
+	s.reverseNames = names
+}
+
+// reverseZone returns the reverse zone name falls in, or the empty string if
+// we are not authoritative for name.
+func (s *Server) reverseZone(name string) string {
+	for _, z := range s.reverseZones {
+		if dns.IsSubDomain(z, name) {
+			return z
+		}
+	}
+	return ""
+}
+
+// ServeDNSReverse answers queries in our reverse zones.
+func (s *Server) ServeDNSReverse(w dns.ResponseWriter, req *dns.Msg) {
+	q := req.Question[0]
+	q.Name = strings.ToLower(q.Name)
+	zone := s.reverseZone(q.Name)
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	m.RecursionAvailable = s.recursionAllowed(w)
+	defer func() {
+		setEdns0(m, req)
+		fit(m, maxSize(w, req))
+		w.WriteMsg(m)
+	}()
+
+	soa := s.createSOA()[0].(*dns.SOA)
+	soa.Hdr.Name = zone
+
+	if q.Name == zone && q.Qtype == dns.TypeSOA {
+		m.Answer = []dns.RR{soa}
+		return
+	}
+	ip := reverseIP(q.Name)
+	if ip == nil {
+		// Not a complete address, these names only exist as parents of
+		// the addresses.
+		m.Ns = []dns.RR{soa}
+		return
+	}
+	records := s.getPTRRecords(q, ip)
+	if len(records) == 0 {
+		m.SetRcode(req, dns.RcodeNameError)
+		m.Ns = []dns.RR{soa}
+		return
+	}
+	if q.Qtype == dns.TypePTR || q.Qtype == dns.TypeANY {
+		m.Answer = records
+		return
+	}
+	m.Ns = []dns.RR{soa}
+}
+
+// getPTRRecords returns the PTR records for the services registered on ip.
+func (s *Server) getPTRRecords(q dns.Question, ip net.IP) (records []dns.RR) {
+	services, _ := s.registry.Get("*")
+	seen := make(map[string]bool)
+	for _, serv := range healthy(services) {
+		if h := net.ParseIP(serv.Host); h == nil || !h.Equal(ip) {
+			continue
+		}
+		names := []string{serv.UUID}
+		if s.reverseNames {
+			names = append(names, servicePattern(serv))
+		}
+		for _, n := range names {
+			ptr := strings.ToLower(n) + "." + s.domain + "."
+			if seen[ptr] {
+				continue
+			}
+			seen[ptr] = true
+			records = append(records, &dns.PTR{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: serv.TTL}, Ptr: ptr})
+		}
+	}
+	if len(records) > 0 {
+		log.Printf("Found %d PTR record(s) for %s", len(records), ip)
+	}
+	return
+}
+
+// servicePattern returns region.version.name.environment for service serv.
+func servicePattern(serv msg.Service) string {
+	return strings.Join([]string{serv.Region, strings.Replace(serv.Version, ".", "-", -1), serv.Name, serv.Environment}, ".")
+}
+
+// reverseIP returns the IP address of a name in in-addr.arpa or ip6.arpa, or
+// nil if the name is not a complete address.
+func reverseIP(name string) net.IP {
+	labels := dns.SplitDomainName(name)
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		if len(labels) != 6 {
+			return nil
+		}
+		octets := make([]string, 4)
+		for i := 0; i < 4; i++ {
+			octets[i] = labels[3-i]
+		}
+		return net.ParseIP(strings.Join(octets, ".")).To4()
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		if len(labels) != 34 {
+			return nil
+		}
+		addr := make([]byte, 0, 39)
+		for i := 0; i < 32; i++ {
+			if len(labels[31-i]) != 1 {
+				return nil
+			}
+			if i > 0 && i%4 == 0 {
+				addr = append(addr, ':')
+			}
+			addr = append(addr, labels[31-i][0])
+		}
+		return net.ParseIP(string(addr))
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns1/stats"
+)
+
+const (
+	rrlIPv4Prefix = 24               // clients in the same IPv4 /24 share their limits
+	rrlIPv6Prefix = 56               // clients in the same IPv6 /56 share their limits
+	rrlIdle       = 60 * time.Second // limits not used for this long are forgotten
+)
+
+// Response categories, each has its own limit.
+const (
+	rrlAnswer   = "answer"
+	rrlNoData   = "nodata"
+	rrlNXDomain = "nxdomain"
+	rrlReferral = "referral"
+	rrlError    = "error"
+)
+
+// What to do with a response.
+const (
+	rrlSend = iota
+	rrlDrop
+	rrlSlip // send an empty truncated response, so the client retries over TCP
+)
+
+// rateLimiter limits the responses over UDP to clients, so SkyDNS can not be
+// used to amplify floods. Clients are grouped by their network prefix, and
+// limited per response category and name, with a token bucket.
+type rateLimiter struct {
+	sync.Mutex
+	limits  map[string]float64 // responses per second by category
+	slip    int                // every slip'th limited response is truncated instead of dropped, 0 drops all
+	allow   []*net.IPNet       // clients that are never limited
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	last    time.Time
+	limited int // responses limited since the bucket was created
+}
+
+// SetRateLimit limits the responses over UDP to responses per second for
+// answers, NODATA replies and referrals, nxdomains per second for NXDOMAIN
+// replies and errors per second for other errors, for each client network,
+// response and name. When nxdomains or errors is 0 responses is used for them.
+// Every slip'th limited response is sent truncated, so a legitimate client
+// can retry over TCP, all others are dropped. Clients in allow are never
+// limited. A limit of 0 responses disables rate limiting.
+func (s *Server) SetRateLimit(responses, nxdomains, errors, slip int, allow []*net.IPNet) {
+	if responses <= 0 {
+		s.rrl = nil
+		return
+	}
+	if nxdomains <= 0 {
+		nxdomains = responses
+	}
+	if errors <= 0 {
+		errors = responses
+	}
+	s.rrl = &rateLimiter{
+		limits: map[string]float64{
+			rrlAnswer:   float64(responses),
+			rrlNoData:   float64(responses),
+			rrlReferral: float64(responses),
+			rrlNXDomain: float64(nxdomains),
+			rrlError:    float64(errors),
+		},
+		slip:    slip,
+		allow:   allow,
+		buckets: make(map[string]*bucket),
+		swept:   time.Now(),
+	}
+}
+
+// check returns what to do with response m to the client at addr.
+func (rl *rateLimiter) check(addr net.Addr, m *dns.Msg) int {
+	a, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return rrlSend
+	}
+	for _, n := range rl.allow {
+		if n.Contains(a.IP) {
+			return rrlSend
+		}
+	}
+	prefix := a.IP.Mask(net.CIDRMask(rrlIPv6Prefix, 128))
+	if ip4 := a.IP.To4(); ip4 != nil {
+		prefix = ip4.Mask(net.CIDRMask(rrlIPv4Prefix, 32))
+	}
+	category, name := responseCategory(m)
+	key := prefix.String() + "/" + category + "/" + name
+
+	rl.Lock()
+	defer rl.Unlock()
+	now := time.Now()
+	if now.Sub(rl.swept) > rrlIdle {
+		for k, b := range rl.buckets {
+			if now.Sub(b.last) > rrlIdle {
+				delete(rl.buckets, k)
+			}
+		}
+		rl.swept = now
+	}
+
+	limit := rl.limits[category]
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{tokens: limit, last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * limit
+	if b.tokens > limit {
+		b.tokens = limit
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return rrlSend
+	}
+	b.limited++
+	if rl.slip > 0 && b.limited%rl.slip == 0 {
+		return rrlSlip
+	}
+	return rrlDrop
+}
+
+// responseCategory returns the category of response m and the name it is
+// limited on. NXDOMAIN replies are limited on the zone, so queries for many
+// random names share a limit.
+func responseCategory(m *dns.Msg) (string, string) {
+	var qname string
+	var qtype uint16
+	if len(m.Question) > 0 {
+		qname, qtype = strings.ToLower(m.Question[0].Name), m.Question[0].Qtype
+	}
+	var soa, ns string
+	for _, r := range m.Ns {
+		switch r.Header().Rrtype {
+		case dns.TypeSOA:
+			soa = strings.ToLower(r.Header().Name)
+		case dns.TypeNS:
+			ns = strings.ToLower(r.Header().Name)
+		}
+	}
+
+	switch {
+	case m.Rcode == dns.RcodeNameError:
+		if soa != "" {
+			return rrlNXDomain, soa
+		}
+		return rrlNXDomain, qname
+	case m.Rcode != dns.RcodeSuccess:
+		return rrlError, ""
+	case len(m.Answer) > 0:
+		return rrlAnswer, qname + "/" + strconv.Itoa(int(qtype))
+	case ns != "" && soa == "":
+		return rrlReferral, ns
+	}
+	return rrlNoData, qname
+}
+
+// rateLimitWriter applies the rate limits to the responses written to it.
+type rateLimitWriter struct {
+	dns.ResponseWriter
+	rl *rateLimiter
+}
+
+func (w *rateLimitWriter) WriteMsg(m *dns.Msg) error {
+	switch w.rl.check(w.RemoteAddr(), m) {
+	case rrlSlip:
+		stats.RateLimitSlipCount.Inc(1)
+		t := new(dns.Msg)
+		t.MsgHdr = m.MsgHdr
+		t.Truncated = true
+		t.Question = m.Question
+		return w.ResponseWriter.WriteMsg(t)
+	case rrlDrop:
+		stats.RateLimitDropCount.Inc(1)
+		return nil
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
@@ -11,12 +11,12 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"math"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -32,12 +32,16 @@ import (
 
 const (
 	raftElectionTimeout = 200 * time.Millisecond
+
+	// Default snapshot settings, see SetSnapshot.
+	snapshotInterval = 5 * time.Minute
+	snapshotCount    = 1000
+
+	// Maximum amount a SRV priority is raised for older versions.
+	maxVersionOffset = 9
 )
 
 /* TODO:
-   Set Priority based on Region
-   Dynamically set Weight/Priority in DNS responses
-   Handle API call for setting host statistics
    Handle Errors in DNS
    Master should cleanup expired services
    TTL cleanup thread should shutdown/start based on being elected master
@@ -49,11 +53,21 @@ func init() {
 	raft.RegisterCommand(&UpdateTTLCommand{})
 	raft.RegisterCommand(&RemoveServiceCommand{})
 	raft.RegisterCommand(&AddCallbackCommand{})
+	raft.RegisterCommand(&SetCallbackCommand{})
+	raft.RegisterCommand(&RemoveCallbackCommand{})
+	raft.RegisterCommand(&SetLoadCommand{})
+	raft.RegisterCommand(&SetTopologyCommand{})
+	raft.RegisterCommand(&SetStubZoneCommand{})
+	raft.RegisterCommand(&RemoveStubZoneCommand{})
+	raft.RegisterCommand(&SetKeysCommand{})
+	raft.RegisterCommand(&SetHealthCommand{})
 }
 
 type Server struct {
 	members     []string // initial members to join with
 	nameservers []string // nameservers to forward to
+	forwarder   *forwarder
+	stubs       *stubZones
 
 	domain       string
 	domainLabels int
@@ -63,12 +77,21 @@ type Server struct {
 	writeTimeout time.Duration
 	waiter       *sync.WaitGroup
 
-	registry registry.Registry
+	registry  registry.Registry
+	watch     *watcher
+	checker   *checker
+	deliverer *deliverer
 
 	dnsUDPServer *dns.Server
 	dnsTCPServer *dns.Server
+	dnsTLSServer *dns.Server
 	dnsHandler   *dns.ServeMux
 
+	// DNS-over-TLS, disabled when dnsTLSAddr is empty
+	dnsTLSAddr string
+	dnsTLSPem  string
+	dnsTLSKey  string
+
 	httpServer *http.Server
 	router     *mux.Router
 
@@ -76,12 +99,52 @@ type Server struct {
 	dataDir    string
 	secret     string
 
+	// Raft snapshotting and log compaction
+	snapshotInterval time.Duration
+	snapshotCount    uint64
+	snapshotIndex    uint64 // commit index of the last snapshot taken or loaded
+
 	// DNSSEC key material
 	dnsKey  *dns.DNSKEY
 	keyTag  uint16
 	privKey dns.PrivateKey
+	keys    *keyManager // nil when the keys are not generated by SkyDNS
+
+	// DNSSEC signatures, the zone is signed in the background when it changed
+	sigs          *sigCache
+	resignPending chan bool
+
+	// NSEC3 parameters, nsec3Param is nil when NSEC is used
+	nsec3Param *dns.NSEC3PARAM
+
+	// Zone transfers
+	transferNets []*net.IPNet
+	transferKeys map[string]string // TSIG secrets by key name
+	zones        *zoneHistory
+
+	loadTimeout time.Duration // load reports older than this are ignored
+
+	// Regions of the clients, most specific network first
+	regionNets regionNetworks
+
+	rrl *rateLimiter // nil when responses are not rate limited
+
+	// Answers per reply, 0 is unlimited, and how they are chosen
+	answerLimit int
+	sticky      bool // choose by the client's address instead of at random
+
+	recursionNets []*net.IPNet // clients that may recurse, nil allows everyone
 
-	roundrobin bool
+	// Reverse zones we are authoritative for
+	reverseZones []string
+	reverseNames bool // also return the service names in PTR records
+
+	// Secondaries that get a NOTIFY when the zone changes
+	secondaries   []string
+	notifyPending chan bool
+
+	roundrobin      bool
+	versionPriority bool // give the newest versions a better SRV priority
 
 	//private key and pem for tls
 	tlskey string
@@ -100,14 +163,29 @@ func NewServer(members []string, domain string, dnsAddr string, httpAddr string,
 		writeTimeout: wt,
 		router:       mux.NewRouter(),
 		registry:     registry.New(),
+		watch:        newWatcher(),
+		checker:      newChecker(),
+		deliverer:    newDeliverer(),
+		zones:        newZoneHistory(),
 		dataDir:      dataDir,
 		dnsHandler:   dns.NewServeMux(),
 		waiter:       new(sync.WaitGroup),
 		secret:       secret,
 		nameservers:  nameservers,
+		forwarder:    newForwarder(nameservers),
+		stubs:        newStubZones(),
 		roundrobin:   roundrobin,
 		tlskey:       tlskey,
 		tlspem:       tlspem,
+
+		snapshotInterval: snapshotInterval,
+		snapshotCount:    snapshotCount,
+
+		loadTimeout:   loadTimeout,
+		notifyPending: make(chan bool, 1),
+
+		sigs:          newSigCache(sigCacheSize),
+		resignPending: make(chan bool, 1),
 	}
 
 	if _, err := os.Stat(s.dataDir); os.IsNotExist(err) {
@@ -127,6 +205,20 @@ func NewServer(members []string, domain string, dnsAddr string, httpAddr string,
 	s.router.HandleFunc("/skydns/services/{uuid}", authWrapper(s.updateServiceHTTPHandler)).Methods("PATCH")
 
 	s.router.HandleFunc("/skydns/callbacks/{uuid}", authWrapper(s.addCallbackHTTPHandler)).Methods("PUT")
+	s.router.HandleFunc("/skydns/callbacks/{uuid}", authWrapper(s.removeCallbackHTTPHandler)).Methods("DELETE")
+	s.router.HandleFunc("/skydns/callbacks/", authWrapper(s.getCallbacksHTTPHandler)).Methods("GET")
+
+	s.router.HandleFunc("/skydns/load/{host}", authWrapper(s.setLoadHTTPHandler)).Methods("PUT")
+	s.router.HandleFunc("/skydns/load/", authWrapper(s.getLoadsHTTPHandler)).Methods("GET")
+
+	s.router.HandleFunc("/skydns/topology/", authWrapper(s.setTopologyHTTPHandler)).Methods("PUT")
+	s.router.HandleFunc("/skydns/topology/", authWrapper(s.getTopologyHTTPHandler)).Methods("GET")
+
+	s.router.HandleFunc("/skydns/stubzones/{domain}", authWrapper(s.setStubZoneHTTPHandler)).Methods("PUT")
+	s.router.HandleFunc("/skydns/stubzones/{domain}", authWrapper(s.removeStubZoneHTTPHandler)).Methods("DELETE")
+	s.router.HandleFunc("/skydns/stubzones/", authWrapper(s.getStubZonesHTTPHandler)).Methods("GET")
+
+	s.router.HandleFunc("/skydns/dnssec/", authWrapper(s.getKeysHTTPHandler)).Methods("GET")
 
 	// External API Routes
 	// /skydns/services #list all services
@@ -135,6 +227,11 @@ func NewServer(members []string, domain string, dnsAddr string, httpAddr string,
 	s.router.HandleFunc("/skydns/regions/", authWrapper(s.getRegionsHTTPHandler)).Methods("GET")
 	// /skydns/environnments #list all environments
 	s.router.HandleFunc("/skydns/environments/", authWrapper(s.getEnvironmentsHTTPHandler)).Methods("GET")
+	// /skydns/watch #stream changes to the registry
+	s.router.HandleFunc("/skydns/watch/", authWrapper(s.watchHTTPHandler)).Methods("GET")
+
+	// DNS-over-HTTPS, like DNS itself it does not use the shared secret
+	s.router.HandleFunc("/dns-query", s.dnsQueryHTTPHandler).Methods("GET", "POST")
 
 	// Raft Routes
 	s.router.HandleFunc("/raft/join", s.joinHandler).Methods("POST")
@@ -156,6 +253,37 @@ func (s *Server) KeyTag() uint16 { return s.keyTag }
 // PrivateKey returns the private key of the server.
 func (s *Server) PrivateKey() dns.PrivateKey { return s.privKey }
 
+// SetSnapshot sets how often the raft log is compacted. Every interval a
+// snapshot of the registry is taken if at least count commands have been
+// applied since the previous snapshot. An interval of 0 disables snapshotting.
+func (s *Server) SetSnapshot(interval time.Duration, count uint64) {
+	s.snapshotInterval = interval
+	s.snapshotCount = count
+}
+
+// SetVersionPriority enables or disables version priorities. When enabled the
+// newest version in a SRV answer keeps its priority and older versions get a
+// worse (higher) priority.
+func (s *Server) SetVersionPriority(b bool) {
+	s.versionPriority = b
+}
+
+// stateMachine is the raft state machine, the registry. Recovering the registry
+// from a snapshot loses the events before the snapshot, the watcher is told
+// so resumed watches do not silently miss them. The stub zones may change.
+type stateMachine struct {
+	s *Server
+}
+
+func (m *stateMachine) Save() ([]byte, error) { return m.s.registry.Save() }
+
+func (m *stateMachine) Recovery(b []byte) error {
+	m.s.watch.recover()
+	err := m.s.registry.Recovery(b)
+	m.s.updateStubZones()
+	return err
+}
+
 // Start starts a DNS server and blocks waiting to be killed.
 func (s *Server) Start() (*sync.WaitGroup, error) {
 	var err error
@@ -163,11 +291,22 @@ func (s *Server) Start() (*sync.WaitGroup, error) {
 
 	// Initialize and start Raft server.
 	transporter := raft.NewHTTPTransporter("/raft", raftElectionTimeout)
-	s.raftServer, err = raft.NewServer(s.HTTPAddr(), s.dataDir, transporter, nil, s.registry, "")
+	s.raftServer, err = raft.NewServer(s.HTTPAddr(), s.dataDir, transporter, &stateMachine{s}, s, "")
 	if err != nil {
 		log.Fatal(err)
 	}
 	transporter.Install(s.raftServer, s)
+	if err := s.raftServer.Init(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Recover the registry from the latest snapshot, only the log
+	// entries after it have to be replayed.
+	if err := s.raftServer.LoadSnapshot(); err == nil {
+		s.snapshotIndex = s.raftServer.CommitIndex()
+		s.watch.reset(s.snapshotIndex)
+		log.Println("Loaded snapshot at index", s.snapshotIndex)
+	}
 	s.raftServer.Start()
 
 	// Join to leader if specified.
@@ -208,6 +347,7 @@ func (s *Server) Start() (*sync.WaitGroup, error) {
 		Handler:      s.dnsHandler,
 		ReadTimeout:  s.readTimeout,
 		WriteTimeout: s.writeTimeout,
+		TsigSecret:   s.transferKeys,
 	}
 
 	s.dnsUDPServer = &dns.Server{
@@ -217,8 +357,11 @@ func (s *Server) Start() (*sync.WaitGroup, error) {
 		UDPSize:      65535,
 		ReadTimeout:  s.readTimeout,
 		WriteTimeout: s.writeTimeout,
+		TsigSecret:   s.transferKeys,
 	}
 
+	// Watches take over their connection, so they are not limited by the
+	// WriteTimeout.
 	s.httpServer = &http.Server{
 		Addr:           s.HTTPAddr(),
 		Handler:        s.router,
@@ -227,6 +370,10 @@ func (s *Server) Start() (*sync.WaitGroup, error) {
 		MaxHeaderBytes: 1 << 20,
 	}
 
+	s.deliverer.start()
+	go s.notifyLoop()
+	go s.resignLoop()
+	s.resign()
 	go s.listenAndServe()
 
 	s.waiter.Add(1)
@@ -271,10 +418,17 @@ func (s *Server) run() {
 	var (
 		tick = time.NewTicker(1 * time.Second)
 		sig  = make(chan os.Signal)
+		snap <-chan time.Time
 	)
 	signal.Notify(sig, os.Interrupt)
 	defer tick.Stop()
 
+	if s.snapshotInterval > 0 {
+		snapTick := time.NewTicker(s.snapshotInterval)
+		defer snapTick.Stop()
+		snap = snapTick.C
+	}
+
 	for {
 		select {
 		case <-tick.C:
@@ -287,9 +441,15 @@ func (s *Server) run() {
 				// and new leader will take over anyway
 				for _, uuid := range expired {
 					stats.ExpiredCount.Inc(1)
-					s.raftServer.Do(NewRemoveServiceCommand(uuid))
+					s.raftServer.Do(NewExpireServiceCommand(uuid))
 				}
+				s.checkHealth()
+				s.manageKeys()
+			} else {
+				s.checker.reset()
 			}
+		case <-snap:
+			s.snapshot()
 		case <-sig:
 			s.Stop()
 			return
@@ -297,6 +457,23 @@ func (s *Server) run() {
 	}
 }
 
+// snapshot takes a snapshot of the registry and compacts the raft log, but
+// only if enough commands have been applied since the last snapshot. Every member
+// compacts its own log, a follower that is too far behind the leader's compacted
+// log is sent the leader's snapshot instead.
+func (s *Server) snapshot() {
+	index := s.raftServer.CommitIndex()
+	if index < s.snapshotIndex+s.snapshotCount {
+		return
+	}
+	if err := s.raftServer.TakeSnapshot(); err != nil {
+		log.Println("Error: failed to take snapshot:", err)
+		return
+	}
+	s.snapshotIndex = index
+	log.Println("Took snapshot at index", index)
+}
+
 // Join joins an existing SkyDNS cluster.
 func (s *Server) Join(members []string) error {
 	command := &raft.DefaultJoinCommand{
@@ -361,6 +538,9 @@ func (s *Server) joinHandler(w http.ResponseWriter, req *http.Request) {
 // it to a real dns server and returning a response.
 func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	stats.RequestCount.Inc(1)
+	if s.rrl != nil {
+		w = &rateLimitWriter{w, s.rrl}
+	}
 
 	q := req.Question[0]
 
@@ -369,68 +549,107 @@ func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 
 	log.Printf("Received DNS Request for %q from %q with type %d", q.Name, w.RemoteAddr(), q.Qtype)
 
+	if s.reverseZone(q.Name) != "" {
+		s.ServeDNSReverse(w, req)
+		return
+	}
+
 	// If the query does not fall in our s.domain, forward it
 	if !strings.HasSuffix(q.Name, dns.Fqdn(s.domain)) {
+		if !s.recursionAllowed(w) {
+			log.Printf("Refused recursion for %q to %q", q.Name, w.RemoteAddr())
+			m := new(dns.Msg)
+			m.SetRcode(req, dns.RcodeRefused)
+			w.WriteMsg(m)
+			return
+		}
 		s.ServeDNSForward(w, req)
 		return
 	}
+	if q.Qtype == dns.TypeAXFR || q.Qtype == dns.TypeIXFR {
+		s.ServeDNSTransfer(w, req)
+		return
+	}
+	client, _ := clientAddress(w, req)
+	region, subnet := s.clientRegion(w, req)
+
 	m := new(dns.Msg)
 	m.SetReply(req)
 	m.Authoritative = true
-	m.RecursionAvailable = true
+	m.RecursionAvailable = s.recursionAllowed(w)
 	m.Answer = make([]dns.RR, 0, 10)
+	keys := s.zoneKeys(time.Now().UTC())
+	if keys != nil && s.answerLimit > 0 && !s.sticky {
+		if opt := req.IsEdns0(); opt != nil && opt.Do() {
+			// Every subset is signed on its own, give all clients the
+			// same one so its signature is cached. Sticky clients keep
+			// their own subset, which is signed once.
+			client = everyone
+		}
+	}
 	defer func() {
 		// Check if we need to do DNSSEC and sign the reply
-		if s.PublicKey() != nil {
+		if keys != nil {
 			if opt := req.IsEdns0(); opt != nil && opt.Do() {
 				s.nsec(m)
-				s.sign(m, opt.UDPSize())
+				s.sign(m, keys)
 			}
 		}
+		setEdns0(m, req)
+		if subnet != nil {
+			setSubnet(m, subnet)
+		}
+		fit(m, maxSize(w, req))
 		w.WriteMsg(m)
 	}()
 
 	if q.Name == dns.Fqdn(s.domain) {
 		switch q.Qtype {
 		case dns.TypeDNSKEY:
-			if s.PublicKey() != nil {
-				m.Answer = append(m.Answer, s.PublicKey())
+			if keys != nil {
+				for _, k := range keys.published {
+					m.Answer = append(m.Answer, k)
+				}
 				return
 			}
 		case dns.TypeSOA:
 			m.Answer = s.createSOA()
 			return
+		case dns.TypeNSEC3PARAM:
+			if keys != nil && s.nsec3Param != nil {
+				m.Answer = append(m.Answer, s.nsec3Param)
+				return
+			}
 		}
 	}
-	if q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA {
-		records, err := s.getARecords(q)
+	if q.Qtype == dns.TypeTXT {
+		records, err := s.getTXTRecords(q)
 		if err != nil {
 			m.SetRcode(req, dns.RcodeNameError)
 			m.Ns = s.createSOA()
 			return
 		}
-		if s.roundrobin {
-			switch l := uint16(len(records)); l {
-			case 1:
-			case 2:
-				if dns.Id()%2 == 0 {
-					records[0], records[1] = records[1], records[0]
-				}
-			default:
-				// Do a minimum of l swap, maximum of 4l swaps
-				for j := 0; j < int(l*(dns.Id()%4+1)); j++ {
-					q := dns.Id() % l
-					p := dns.Id() % l
-					if q == p {
-						p = (p + 1) % l
-					}
-					records[q], records[p] = records[p], records[q]
-				}
-			}
-		}
 		m.Answer = append(m.Answer, records...)
+		if len(m.Answer) == 0 {
+			m.Ns = s.createSOA()
+		}
+		return
 	}
-	records, extra, err := s.getSRVRecords(q)
+	if q.Qtype == dns.TypeANY {
+		if records, err := s.getTXTRecords(q); err == nil {
+			m.Answer = append(m.Answer, records...)
+		}
+	}
+	if q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA {
+		records, err := s.getARecords(q, region, client, m.RecursionAvailable)
+		if err != nil {
+			m.SetRcode(req, dns.RcodeNameError)
+			m.Ns = s.createSOA()
+			return
+		}
+		m.Answer = append(m.Answer, s.limitAnswer(records)...)
+	}
+	records, extra, err := s.getSRVRecords(q, region, client)
 	if err != nil && len(m.Answer) == 0 {
 		// We are authoritative for this name, but it does not exist: NXDOMAIN
 		m.SetRcode(req, dns.RcodeNameError)
@@ -438,6 +657,7 @@ func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		return
 	}
 	if q.Qtype == dns.TypeANY || q.Qtype == dns.TypeSRV {
+		records, extra = s.limitSRV(records, extra)
 		m.Answer = append(m.Answer, records...)
 		m.Extra = append(m.Extra, extra...)
 	}
@@ -447,9 +667,11 @@ func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	}
 }
 
-// ServeDNSForward forwards a request to a nameservers and returns the response.
+// ServeDNSForward forwards a request to a nameservers, of the stub zone the
+// name is in or else the default ones, and returns the response.
 func (s *Server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg) {
-	if len(s.nameservers) == 0 {
+	f := s.forwarderFor(req.Question[0].Name)
+	if len(f.upstreams) == 0 {
 		log.Printf("Error: Failure to Forward DNS Request, no servers configured %q", dns.ErrServ)
 		m := new(dns.Msg)
 		m.SetReply(req)
@@ -463,26 +685,30 @@ func (s *Server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg) {
 	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
 		network = "tcp"
 	}
-	c := &dns.Client{Net: network, ReadTimeout: 5 * time.Second}
 
-	// Use request Id for "random" nameserver selection
-	nsid := int(req.Id) % len(s.nameservers)
-	try := 0
-Redo:
-	r, _, err := c.Exchange(req, s.nameservers[nsid])
+	key := cacheKey(req)
+	cache := f.cache
+	if cache != nil {
+		// A cached reply that is too large for UDP is fetched again,
+		// so the client gets a truncated reply and retries over TCP.
+		if r := cache.get(key); r != nil && (network == "tcp" || r.Len() <= udpSize(req)) {
+			stats.ForwardCacheHitCount.Inc(1)
+			r.Id = req.Id
+			r.Question = req.Question
+			w.WriteMsg(r)
+			return
+		}
+		stats.ForwardCacheMissCount.Inc(1)
+	}
+
+	r, err := f.exchange(req, network)
 	if err == nil {
-		log.Printf("Forwarded DNS Request %q to %q", req.Question[0].Name, s.nameservers[nsid])
+		if cache != nil {
+			cache.add(key, r)
+		}
 		w.WriteMsg(r)
 		return
 	}
-	// Seen an error, this can only mean, "server not reached", try again
-	// but only if we have not exausted our nameservers
-	if try < len(s.nameservers) {
-		log.Printf("Error: Failure to Forward DNS Request %q to %q", err, s.nameservers[nsid])
-		try++
-		nsid = (nsid + 1) % len(s.nameservers)
-		goto Redo
-	}
 
 	log.Printf("Error: Failure to Forward DNS Request %q", err)
 	m := new(dns.Msg)
@@ -491,11 +717,104 @@ Redo:
 	w.WriteMsg(m)
 }
 
-func (s *Server) getARecords(q dns.Question) (records []dns.RR, err error) {
+// udpSize returns the size of the largest UDP reply the sender of req accepts.
+func udpSize(req *dns.Msg) int {
+	if opt := req.IsEdns0(); opt != nil && opt.UDPSize() > dns.MinMsgSize {
+		return int(opt.UDPSize())
+	}
+	return dns.MinMsgSize
+}
+
+// maxSize returns the size of the largest reply to req that may be written to
+// w, only replies over UDP are limited.
+func maxSize(w dns.ResponseWriter, req *dns.Msg) int {
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		return udpSize(req)
+	}
+	return dns.MaxMsgSize
+}
+
+// setEdns0 adds an OPT record to reply m when the request req has one and m
+// does not, RFC 6891.
+func setEdns0(m, req *dns.Msg) {
+	if req.IsEdns0() == nil || m.IsEdns0() != nil {
+		return
+	}
+	o := new(dns.OPT)
+	o.Hdr.Name = "."
+	o.Hdr.Rrtype = dns.TypeOPT
+	o.SetUDPSize(4096)
+	m.Extra = append(m.Extra, o)
+}
+
+// fit compresses reply m and makes it fit in size bytes. First the additional
+// section is dropped, except for the OPT record. If m still does not fit it is
+// truncated: the authority section and the last answers are dropped and TC is
+// set, so the client retries over TCP. A signed reply loses all its answers,
+// an incomplete RRset or one without its signature does not validate.
+func fit(m *dns.Msg, size int) {
+	m.Compress = true
+	if m.Len() <= size {
+		return
+	}
+	extra := m.Extra
+	m.Extra = nil
+	for _, r := range extra {
+		if r.Header().Rrtype == dns.TypeOPT {
+			m.Extra = append(m.Extra, r)
+		}
+	}
+	if m.Len() <= size {
+		return
+	}
+
+	m.Truncated = true
+	m.Ns = nil
+	answer := m.Answer
+	for _, r := range answer {
+		if r.Header().Rrtype == dns.TypeRRSIG {
+			m.Answer = nil
+			return
+		}
+	}
+	// the number of answers that no longer fits
+	n := sort.Search(len(answer)+1, func(i int) bool {
+		m.Answer = answer[:i]
+		return m.Len() > size
+	})
+	if n > 0 {
+		n--
+	}
+	m.Answer = answer[:n]
+}
+
+// getARecords returns the A or AAAA records for q. The services in region are
+// returned first, followed by those in the other regions ordered by the region
+// topology. The records of each region are shuffled for the client at address
+// client, which may be nil. Services with a hostname are returned as a CNAME
+// chain, or their addresses, see hostRecords. Hostnames outside our domain are
+// only resolved when the client may recurse.
+func (s *Server) getARecords(q dns.Question, region string, client net.IP, recurse bool) ([]dns.RR, error) {
+	return s.aRecords(q, region, client, recurse, 0)
+}
+
+func (s *Server) aRecords(q dns.Question, region string, client net.IP, recurse bool, depth int) ([]dns.RR, error) {
+	records, hosts, addressed, err := s.addressRecords(q, region, client)
+	if len(hosts) > 0 {
+		records = append(records, s.hostRecords(q, region, client, recurse, !addressed, hosts, depth)...)
+	}
+	return records, err
+}
+
+// addressRecords returns the A or AAAA records for q of the services with an
+// address, like getARecords, and the services with a hostname. Addressed is
+// true when the name has addresses of any type, not only those of q.Qtype.
+func (s *Server) addressRecords(q dns.Question, region string, client net.IP) (records []dns.RR, hosts []msg.Service, addressed bool, err error) {
 	var h string
 	name := strings.TrimSuffix(q.Name, ".")
 
 	if name == s.domain {
+		addressed = true
 		for _, m := range s.Members() {
 			h, _, err = net.SplitHostPort(m)
 
@@ -509,6 +828,7 @@ func (s *Server) getARecords(q dns.Question) (records []dns.RR, err error) {
 	}
 	// Leader should always be listed
 	if name == "leader."+s.domain || name == "master."+s.domain || name == s.domain {
+		addressed = true
 		h, _, err = net.SplitHostPort(s.Leader())
 		if err != nil {
 			return
@@ -534,111 +854,187 @@ func (s *Server) getARecords(q dns.Question) (records []dns.RR, err error) {
 			err = nil
 		}
 	}
-
-	for _, serv := range services {
-		ip := net.ParseIP(serv.Host)
-		switch {
-		case ip == nil:
-			continue
-		case ip.To4() != nil && q.Qtype == dns.TypeA:
-			records = append(records, &dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: serv.TTL}, A: ip.To4()})
-		case ip.To4() == nil && q.Qtype == dns.TypeAAAA:
-			records = append(records, &dns.AAAA{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: serv.TTL}, AAAA: ip.To16()})
+	services = healthy(services)
+
+	// The services in region come first, then those in the nearest regions,
+	// etc. Each group is shuffled on its own.
+	groups, _ := s.regionGroups(region, services)
+	for _, group := range groups {
+		n := len(records)
+		for _, serv := range group {
+			ip := net.ParseIP(serv.Host)
+			if ip != nil {
+				addressed = true
+			}
+			switch {
+			case ip == nil:
+				hosts = append(hosts, serv)
+			case ip.To4() != nil && q.Qtype == dns.TypeA:
+				records = append(records, &dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: serv.TTL}, A: ip.To4()})
+			case ip.To4() == nil && q.Qtype == dns.TypeAAAA:
+				records = append(records, &dns.AAAA{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: serv.TTL}, AAAA: ip.To16()})
+			}
 		}
+		s.shuffle(records[n:], unitWeight, client, s.answerLimit-n)
 	}
 	return
 }
 
-func (s *Server) getSRVRecords(q dns.Question) (records []dns.RR, extra []dns.RR, err error) {
-	var weight uint16
-	services := make([]msg.Service, 0)
+// getTXTRecords returns the metadata of the services as TXT records. For
+// UUID.skydns.local a single TXT record with the metadata of that service is
+// returned. For other names there is a TXT record for every matching service
+// that has metadata, which starts with uuid=UUID so the service can be identified.
+func (s *Server) getTXTRecords(q dns.Question) (records []dns.RR, err error) {
+	var (
+		services []msg.Service
+		key      = strings.TrimSuffix(q.Name, s.domain+".")
+		uuid     bool
+	)
 
-	key := strings.TrimSuffix(q.Name, s.domain+".")
 	services, err = s.registry.Get(key)
-
-	if err != nil {
-		return
-	}
-
-	weight = 0
-	if len(services) > 0 {
-		weight = uint16(math.Floor(float64(100 / len(services))))
+	if len(services) == 0 && len(key) > 1 {
+		// no services found, try UUID.skydns.local
+		service, e := s.registry.GetUUID(key[:len(key)-1])
+		if e == nil {
+			services = append(services, service)
+			uuid = true
+			err = nil
+		}
 	}
+	services = healthy(services)
 
 	for _, serv := range services {
-		// TODO: Dynamically set weight
-		// a Service may have an IP as its Host"name", in this case
-		// substitute UUID + "." + s.domain+"." an add an A record
-		// with the name and IP in the additional section.
-		// TODO(miek): check if resolvers actually grok this
-		ip := net.ParseIP(serv.Host)
-		switch {
-		case ip == nil:
-			records = append(records, &dns.SRV{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: serv.TTL},
-				Priority: 10, Weight: weight, Port: serv.Port, Target: serv.Host + "."})
+		if len(serv.Metadata) == 0 {
 			continue
-		case ip.To4() != nil:
-			extra = append(extra, &dns.A{Hdr: dns.RR_Header{Name: serv.UUID + "." + s.domain + ".", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: serv.TTL}, A: ip.To4()})
-			records = append(records, &dns.SRV{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: serv.TTL},
-				Priority: 10, Weight: weight, Port: serv.Port, Target: serv.UUID + "." + s.domain + "."})
-		case ip.To16() != nil:
-			extra = append(extra, &dns.AAAA{Hdr: dns.RR_Header{Name: serv.UUID + "." + s.domain + ".", Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: serv.TTL}, AAAA: ip.To16()})
-			records = append(records, &dns.SRV{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: serv.TTL},
-				Priority: 10, Weight: weight, Port: serv.Port, Target: serv.UUID + "." + s.domain + "."})
-		default:
-			panic("skydns: internal error")
 		}
+		txt := make([]string, 0, len(serv.Metadata)+1)
+		if !uuid {
+			txt = append(txt, "uuid="+serv.UUID)
+		}
+		keys := make([]string, 0, len(serv.Metadata))
+		for k := range serv.Metadata {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			t := k + "=" + serv.Metadata[k]
+			if len(t) > 255 { // maximum length of a character-string
+				t = t[:255]
+			}
+			txt = append(txt, t)
+		}
+		records = append(records, &dns.TXT{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: serv.TTL}, Txt: txt})
 	}
+	return
+}
+
+// getSRVRecords returns the SRV records for q and the A and AAAA records for
+// the additional section. The services in the region named in q, or else in
+// region, get priority 10, the services in other regions get a higher priority
+// depending on the region topology. The records are sorted on priority and
+// shuffled by weight for the client at address client, which may be nil.
+func (s *Server) getSRVRecords(q dns.Question, region string, client net.IP) ([]dns.RR, []dns.RR, error) {
+	return s.srvRecords(q, region, client, s.weights)
+}
 
-	// Append matching entries in different region than requested with a higher priority
+// srvRecords returns the SRV records for q like getSRVRecords, with the
+// weights of the services in each region returned by weights.
+func (s *Server) srvRecords(q dns.Question, region string, client net.IP, weights func([]msg.Service) map[string]uint16) (records []dns.RR, extra []dns.RR, err error) {
+	services := make([]msg.Service, 0)
+
+	key := strings.TrimSuffix(q.Name, s.domain+".")
 	labels := dns.SplitDomainName(key)
 
 	pos := len(labels) - 4
 	if len(labels) >= 4 && labels[pos] != "*" {
-		region := labels[pos]
+		// The region must have services, matching entries in other
+		// regions are appended with a higher priority.
+		if _, err = s.registry.Get(key); err != nil {
+			return
+		}
+		region = labels[pos]
 		labels[pos] = "*"
+		key = strings.Join(labels, ".")
+	}
 
-		// TODO: This is pretty much a copy of the above, and should be abstracted
-		additionalServices := make([]msg.Service, len(services))
-		additionalServices, err = s.registry.Get(strings.Join(labels, "."))
-
-		if err != nil {
-			return
+	services, err = s.registry.Get(key)
+	if err != nil {
+		return
+	}
+	services = healthy(services)
+
+	groups, ranks := s.regionGroups(region, services)
+	for i, group := range groups {
+		w := weights(group)
+		offsets := s.versionOffsets(group)
+		for _, serv := range group {
+			srv, a := s.newSRV(q, serv, uint16(10+10*ranks[i])+offsets[serv.UUID], w[serv.UUID])
+			records = append(records, srv)
+			if a != nil {
+				extra = append(extra, a)
+			}
 		}
+	}
+	s.orderSRV(records, client)
+	return
+}
 
-		weight = 0
-		if len(additionalServices) <= len(services) {
-			return
+// newSRV returns the SRV record for service serv. A service may have an IP as
+// its Host"name", in this case UUID.skydns.local is used as the target and the
+// A or AAAA record for it is returned as well, for the additional section.
+// TODO(miek): check if resolvers actually grok this
+func (s *Server) newSRV(q dns.Question, serv msg.Service, priority, weight uint16) (dns.RR, dns.RR) {
+	srv := &dns.SRV{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: serv.TTL},
+		Priority: priority, Weight: weight, Port: serv.Port, Target: serv.UUID + "." + s.domain + "."}
+
+	ip := net.ParseIP(serv.Host)
+	switch {
+	case ip == nil:
+		srv.Target = serv.Host + "."
+		return srv, nil
+	case ip.To4() != nil:
+		return srv, &dns.A{Hdr: dns.RR_Header{Name: srv.Target, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: serv.TTL}, A: ip.To4()}
+	default:
+		return srv, &dns.AAAA{Hdr: dns.RR_Header{Name: srv.Target, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: serv.TTL}, AAAA: ip.To16()}
+	}
+}
+
+// versionOffsets returns the amount the SRV priority of each service (by UUID)
+// must be raised: 0 for the newest version, 1 for the next newest, etc. Services
+// without a semantic version come last. It returns nil when version priorities
+// are disabled.
+func (s *Server) versionOffsets(services []msg.Service) map[string]uint16 {
+	if !s.versionPriority {
+		return nil
+	}
+	// distinct versions, newest first
+	versions := make([]registry.Version, 0, 3)
+	for _, serv := range services {
+		v := registry.ParseVersion(serv.Version)
+		if v == nil {
+			continue
+		}
+		i := sort.Search(len(versions), func(i int) bool { return !v.Less(versions[i]) })
+		if i < len(versions) && !versions[i].Less(v) {
+			continue
 		}
+		versions = append(versions, nil)
+		copy(versions[i+1:], versions[i:])
+		versions[i] = v
+	}
 
-		weight = uint16(math.Floor(float64(100 / (len(additionalServices) - len(services)))))
-		for _, serv := range additionalServices {
-			// Exclude entries we already have
-			if strings.ToLower(serv.Region) == region {
-				continue
-			}
-			// TODO: Dynamically set priority and weight
-			// TODO(miek): same as above: abstract away
-			ip := net.ParseIP(serv.Host)
-			switch {
-			case ip == nil:
-				records = append(records, &dns.SRV{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: serv.TTL},
-					Priority: 20, Weight: weight, Port: serv.Port, Target: serv.Host + "."})
-				continue
-			case ip.To4() != nil:
-				extra = append(extra, &dns.A{Hdr: dns.RR_Header{Name: serv.UUID + "." + s.domain + ".", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: serv.TTL}, A: ip.To4()})
-				records = append(records, &dns.SRV{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: serv.TTL},
-					Priority: 20, Weight: weight, Port: serv.Port, Target: serv.UUID + "." + s.domain + "."})
-			case ip.To16() != nil:
-				extra = append(extra, &dns.AAAA{Hdr: dns.RR_Header{Name: serv.UUID + "." + s.domain + ".", Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: serv.TTL}, AAAA: ip.To16()})
-				records = append(records, &dns.SRV{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: serv.TTL},
-					Priority: 20, Weight: weight, Port: serv.Port, Target: serv.UUID + "." + s.domain + "."})
-			default:
-				panic("skydns: internal error")
-			}
+	offsets := make(map[string]uint16, len(services))
+	for _, serv := range services {
+		rank := len(versions)
+		if v := registry.ParseVersion(serv.Version); v != nil {
+			rank = sort.Search(len(versions), func(i int) bool { return !v.Less(versions[i]) })
 		}
+		if rank > maxVersionOffset {
+			rank = maxVersionOffset
+		}
+		offsets[serv.UUID] = uint16(rank)
 	}
-	return
+	return offsets
 }
 
 // Returns the connection string.
@@ -662,6 +1058,10 @@ func (s *Server) listenAndServe() {
 		}
 	}()
 
+	if s.dnsTLSAddr != "" {
+		go s.serveTLS()
+	}
+
 	go func() {
 		if s.tlskey != "" {
 			log.Print("Starting http server with tls")
@@ -738,8 +1138,13 @@ func (s *Server) addServiceHTTPHandler(w http.ResponseWriter, req *http.Request)
 		http.Error(w, "Host and Port required", http.StatusBadRequest)
 		return
 	}
+	if err := validateCheck(serv.Check); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	serv.UUID = uuid
+	serv.Health = nil // only set by the health checks
 
 	if _, err := s.raftServer.Do(NewAddServiceCommand(serv)); err != nil {
 		switch err {
@@ -868,13 +1273,32 @@ func (s *Server) authHTTPWrapper(handler http.HandlerFunc) http.HandlerFunc {
 	return handler
 }
 
+// serialBase is added to the raft index to get the serial of the zone. Older
+// versions used the time as the serial, the base is above those serials so
+// secondaries see the serial increase after an upgrade (RFC 1982).
+const serialBase = 2000000000
+
+// serial returns the serial of the zone, derived from the raft index of the
+// last change to the registry, so it is the same on all members.
+func (s *Server) serial() uint32 {
+	return uint32(serialBase + s.registry.Index())
+}
+
+// zoneChanged records that the command with raft index index changed the zone
+// and notifies the secondaries.
+func (s *Server) zoneChanged(index uint64) {
+	s.registry.SetIndex(index)
+	s.notify()
+	s.resign()
+}
+
 // Return a SOA record for this SkyDNS instance.
 func (s *Server) createSOA() []dns.RR {
 	dom := dns.Fqdn(s.domain)
 	soa := &dns.SOA{Hdr: dns.RR_Header{Name: dom, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
 		Ns:      "master." + dom,
 		Mbox:    "hostmaster." + dom,
-		Serial:  uint32(time.Now().Truncate(time.Hour).Unix()),
+		Serial:  s.serial(),
 		Refresh: 28800,
 		Retry:   7200,
 		Expire:  604800,
@@ -5,15 +5,28 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"github.com/miekg/dns"
 	"github.com/skynetservices/skydns1/msg"
+	"github.com/skynetservices/skydns1/registry"
+	"github.com/skynetservices/skydns1/stats"
 	"io/ioutil"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
@@ -475,8 +488,9 @@ func TestCallbackFailure(t *testing.T) {
 		Name:        "TestService",
 		Version:     "1.0.0",
 		Region:      "Test",
-		Environment: "Testing", // should result in notFound
+		Environment: "Production",
 		Host:        "localhost",
+		Events:      []string{"added"}, // should result in bad request
 		Reply:       "localhost",
 		Port:        9650,
 	}
@@ -487,9 +501,129 @@ func TestCallbackFailure(t *testing.T) {
 	req, _ = http.NewRequest("PUT", "/skydns/callbacks/101", bytes.NewBuffer(b))
 	resp = httptest.NewRecorder()
 
+	s.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusBadRequest {
+		t.Fatal("Callback should result in unknown event.")
+	}
+
+	req, _ = http.NewRequest("DELETE", "/skydns/callbacks/101", nil)
+	resp = httptest.NewRecorder()
 	s.router.ServeHTTP(resp, req)
 	if resp.Code != http.StatusNotFound {
-		t.Fatal("Callback should result in service not found.")
+		t.Fatal("Removing a callback that does not exist should result in not found.")
+	}
+}
+
+func TestCallbackEvents(t *testing.T) {
+	type call struct {
+		method string
+		event  string
+		uuid   string
+	}
+	called := make(chan call, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body struct {
+			UUID  string
+			Event string
+		}
+		json.NewDecoder(req.Body).Decode(&body)
+		called <- call{req.Method, body.Event, body.UUID}
+	}))
+	defer ts.Close()
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(ts.URL, "http://"))
+	p, _ := strconv.Atoi(port)
+
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	// Register the callback before the service exists
+	c := msg.Callback{
+		Domain: "testservice.production",
+		Events: []string{msg.EventAdd, msg.EventRemove},
+		Reply:  host,
+		Port:   uint16(p),
+	}
+	b, _ := json.Marshal(c)
+	req, _ := http.NewRequest("PUT", "/skydns/callbacks/101", bytes.NewBuffer(b))
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("Failed to add callback: %d", resp.Code)
+	}
+
+	m := msg.Service{
+		Name:        "TestService",
+		Version:     "1.0.0",
+		Region:      "Test",
+		Environment: "Production",
+		Host:        "localhost",
+		Port:        9000,
+		TTL:         4,
+	}
+	b, _ = json.Marshal(m)
+	req, _ = http.NewRequest("PUT", "/skydns/services/123", bytes.NewBuffer(b))
+	resp = httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	// Not subscribed to update-ttl, so this must not result in a callback
+	req, _ = http.NewRequest("PATCH", "/skydns/services/123", bytes.NewBufferString(`{"TTL":10}`))
+	resp = httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	req, _ = http.NewRequest("DELETE", "/skydns/services/123", nil)
+	resp = httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	for _, expected := range []call{{"PUT", msg.EventAdd, "123"}, {"DELETE", msg.EventRemove, "123"}} {
+		select {
+		case c := <-called:
+			if c != expected {
+				t.Fatalf("Wrong callback performed: %v, expected %v", c, expected)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Callback for %s not delivered", expected.event)
+		}
+	}
+}
+
+func TestCallbackReAdd(t *testing.T) {
+	called := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		called <- req.Method
+	}))
+	defer ts.Close()
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(ts.URL, "http://"))
+	p, _ := strconv.Atoi(port)
+
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	c := msg.Callback{Domain: "testservice.production", Events: []string{msg.EventAdd, msg.EventRemove}, Reply: host, Port: uint16(p)}
+	b, _ := json.Marshal(c)
+	req, _ := http.NewRequest("PUT", "/skydns/callbacks/101", bytes.NewBuffer(b))
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("Failed to add callback: %d", resp.Code)
+	}
+
+	m := msg.Service{Name: "TestService", Version: "1.0.0", Region: "Test", Environment: "Production", Host: "localhost", Port: 9000, TTL: 4}
+	b, _ = json.Marshal(m)
+	for _, method := range []string{"PUT", "DELETE", "PUT"} {
+		req, _ = http.NewRequest(method, "/skydns/services/123", bytes.NewBuffer(b))
+		resp = httptest.NewRecorder()
+		s.router.ServeHTTP(resp, req)
+	}
+
+	for _, expected := range []string{"PUT", "DELETE", "PUT"} {
+		select {
+		case m := <-called:
+			if m != expected {
+				t.Fatalf("Wrong callback performed: %s, expected %s", m, expected)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Callback %s not delivered", expected)
+		}
 	}
 }
 
@@ -674,6 +808,9 @@ var serviceTestArray []servicesTest = []servicesTest{
 	{"region1.*.*.production", 1},
 	{"region1.*.testservice.production", 1},
 	{"region1.*.TestService.production", 1},
+	{"1.testservice.production", 3},
+	{"1-0-1.testservice.production", 1},
+	{"1-x-0.*.production", 4},
 }
 
 func TestGetServicesWithQueries(t *testing.T) {
@@ -704,6 +841,101 @@ func TestGetServicesWithQueries(t *testing.T) {
 
 }
 
+func TestGetServicesWithMetadata(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	for _, m := range services {
+		if m.UUID == "101" || m.UUID == "104" {
+			m.Metadata = map[string]string{"protocol": "http", "shard": m.UUID}
+		}
+		s.registry.Add(m)
+	}
+
+	tests := []struct {
+		query string
+		count int
+	}{
+		{"?query=production&meta.protocol=http", 2},
+		{"?query=production&meta.protocol=", 2},
+		{"?query=production&meta.protocol=http&meta.shard=104", 1},
+		{"?query=development&meta.protocol=http", 0},
+	}
+	for _, st := range tests {
+		req, _ := http.NewRequest("GET", "/skydns/services/"+st.query, nil)
+		resp := httptest.NewRecorder()
+		s.router.ServeHTTP(resp, req)
+		if st.count == 0 {
+			if resp.Code != http.StatusNotFound {
+				t.Fatal("Expected no services for", st.query)
+			}
+			continue
+		}
+		if resp.Code != http.StatusOK {
+			t.Fatal("Failed To Retrieve Services")
+		}
+		var returnedServices []msg.Service
+		if err := json.Unmarshal(resp.Body.Bytes(), &returnedServices); err != nil {
+			t.Fatal("Failed to unmarshal response from server")
+		}
+		if len(returnedServices) != st.count {
+			t.Fatalf("Expected %d services for %q, got %d", st.count, st.query, len(returnedServices))
+		}
+		if returnedServices[0].Metadata["protocol"] != "http" {
+			t.Fatal("Metadata not returned")
+		}
+	}
+}
+
+func TestDNSTXT(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	for _, m := range services {
+		if m.UUID == "101" {
+			m.Metadata = map[string]string{"shard": "1", "protocol": "http"}
+		}
+		s.registry.Add(m)
+	}
+
+	c := new(dns.Client)
+	m := new(dns.Msg)
+	m.SetQuestion("101.skydns.local.", dns.TypeTXT)
+	resp, _, err := c.Exchange(m, "localhost:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatal("Answer expected to have 1 TXT record but has", len(resp.Answer))
+	}
+	txt := resp.Answer[0].(*dns.TXT).Txt
+	if len(txt) != 2 || txt[0] != "protocol=http" || txt[1] != "shard=1" {
+		t.Fatal("Wrong TXT record for service 101", txt)
+	}
+
+	m.SetQuestion("testservice.production.skydns.local.", dns.TypeTXT)
+	resp, _, err = c.Exchange(m, "localhost:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatal("Answer expected to have 1 TXT record but has", len(resp.Answer))
+	}
+	if txt := resp.Answer[0].(*dns.TXT).Txt; len(txt) != 3 || txt[0] != "uuid=101" {
+		t.Fatal("Wrong TXT record for testservice.production", txt)
+	}
+
+	// Service without metadata: NODATA
+	m.SetQuestion("100.skydns.local.", dns.TypeTXT)
+	resp, _, err = c.Exchange(m, "localhost:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+		t.Fatal("Expected NODATA for a service without metadata")
+	}
+}
+
 func TestDNS(t *testing.T) {
 	s := newTestServer("", "", "")
 	defer s.Stop()
@@ -803,6 +1035,1610 @@ func TestDNSForward(t *testing.T) {
 	// TODO(miek): DNSSEC DO query
 }
 
+func TestForwarder(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP("10.0.0.1")}}
+		w.WriteMsg(m)
+	})}
+	go upstream.ActivateAndServe()
+	defer upstream.Shutdown()
+
+	// Nothing listens on the first nameserver
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+
+	f := newForwarder([]string{dead.LocalAddr().String(), pc.LocalAddr().String()})
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	r, err := f.exchange(m, "udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 1 {
+		t.Fatal("The second nameserver should have answered")
+	}
+	if u := f.ordered(); u[0].addr != pc.LocalAddr().String() {
+		t.Fatal("The failing nameserver should be avoided")
+	}
+
+	// Racing gets the reply of the working nameserver as well
+	f.race = true
+	f.upstreams[0].down = time.Time{}
+	if _, err := f.exchange(m, "udp"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForwardCache(t *testing.T) {
+	c := newDNSCache(2)
+	reply := func(name string, ttl uint32) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		m.Response = true
+		m.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}, A: net.ParseIP("10.0.0.1")}}
+		return m
+	}
+	a, b, d := reply("a.example.com.", 300), reply("b.example.com.", 300), reply("d.example.com.", 0)
+	c.add(cacheKey(a), a)
+	c.add(cacheKey(b), b)
+	c.add(cacheKey(d), d)
+	if c.get(cacheKey(d)) != nil {
+		t.Fatal("A reply with TTL 0 should not be cached")
+	}
+	if r := c.get(cacheKey(a)); r == nil || r.Answer[0].Header().Ttl != 300 {
+		t.Fatal("Reply should be cached with its TTL")
+	}
+	// b is now the least recently used
+	e := reply("e.example.com.", 300)
+	c.add(cacheKey(e), e)
+	if c.get(cacheKey(b)) != nil || c.get(cacheKey(a)) == nil {
+		t.Fatal("The least recently used reply should be removed")
+	}
+
+	nx := new(dns.Msg)
+	nx.SetQuestion("x.example.com.", dns.TypeA)
+	nx.Rcode = dns.RcodeNameError
+	nx.Ns = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600}, Minttl: 60}}
+	if ttl := cacheTTL(nx); ttl != 60 {
+		t.Fatal("NXDOMAIN should be cached for the SOA minimum TTL, not", ttl)
+	}
+	nx.Ns = nil
+	if ttl := cacheTTL(nx); ttl != 0 {
+		t.Fatal("NXDOMAIN without SOA should not be cached")
+	}
+	nx.Rcode = dns.RcodeServerFailure
+	if ttl := cacheTTL(nx); ttl != 0 {
+		t.Fatal("SERVFAIL should not be cached")
+	}
+}
+
+func TestStubZones(t *testing.T) {
+	s := &Server{domain: "skydns.local", registry: registry.New(), forwarder: newForwarder([]string{"8.8.8.8:53"}), stubs: newStubZones()}
+	err := s.SetStubZones(map[string][]string{
+		"corp.internal":     {"10.0.0.1", "10.0.0.2:5353"},
+		"eu.corp.internal.": {"10.1.0.1:53"},
+		"service.consul.":   {"127.0.0.1:8600"},
+		"example.org.":      {"10.9.9.9:53"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"www.corp.internal.":     "10.0.0.1:53",
+		"corp.internal.":         "10.0.0.1:53",
+		"host.eu.corp.internal.": "10.1.0.1:53",
+		"WEB.Service.Consul.":    "127.0.0.1:8600",
+		"consul.":                "8.8.8.8:53",
+		"www.example.com.":       "8.8.8.8:53",
+		"notcorp.internal.":      "8.8.8.8:53",
+	}
+	for name, ns := range tests {
+		if f := s.forwarderFor(name); f.upstreams[0].addr != ns {
+			t.Errorf("%s should be forwarded to %s, not %s", name, ns, f.upstreams[0].addr)
+		}
+	}
+	if f := s.forwarderFor("www.corp.internal."); len(f.upstreams) != 2 || f.upstreams[1].addr != "10.0.0.2:5353" {
+		t.Fatal("All nameservers of the stub zone should be used")
+	}
+
+	// Stub zones set through the API take precedence
+	s.registry.SetStubZone("corp.internal.", []string{"10.0.0.3:53"})
+	s.updateStubZones()
+	if f := s.forwarderFor("www.corp.internal."); f.upstreams[0].addr != "10.0.0.3:53" {
+		t.Fatal("The stub zone from the registry should be used")
+	}
+	s.registry.RemoveStubZone("corp.internal.")
+	s.updateStubZones()
+	if f := s.forwarderFor("www.corp.internal."); f.upstreams[0].addr != "10.0.0.1:53" {
+		t.Fatal("The stub zone given at startup should be used again")
+	}
+
+	// Forwarders of removed stub zones are dropped
+	s.registry.SetStubZone("dev.internal.", []string{"10.0.0.4:53"})
+	s.updateStubZones()
+	s.registry.RemoveStubZone("dev.internal.")
+	s.updateStubZones()
+	if _, ok := s.stubs.forwarders["dev.internal."]; ok || len(s.stubs.forwarders) != 4 {
+		t.Fatal("The forwarder of a removed stub zone should be dropped")
+	}
+
+	for _, d := range []string{"skydns.local.", "db.skydns.local.", ".", "bad..domain"} {
+		if _, _, err := s.checkStubZone(d, []string{"10.0.0.1"}); err != ErrStubZoneInvalid {
+			t.Errorf("Stub zone %q should be invalid", d)
+		}
+	}
+	if _, _, err := s.checkStubZone("corp.internal.", nil); err != ErrNameserverInvalid {
+		t.Error("A stub zone without nameservers should be invalid")
+	}
+}
+
+func TestDNSOverTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skydns-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pemFile, keyFile := writeTestCertificate(t, dir)
+
+	s := &Server{domain: "skydns.local", registry: registry.New(), forwarder: newForwarder(nil), stubs: newStubZones()}
+	s.SetTLS("127.0.0.1:0", pemFile, keyFile)
+	l, err := s.listenTLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnsServer := &dns.Server{Listener: l, Net: "tcp", Handler: s}
+	go dnsServer.ActivateAndServe()
+	defer dnsServer.Shutdown()
+
+	s.registry.Add(msg.Service{UUID: "1", Name: "TestService", Version: "1.0.0", Region: "Test", Host: "10.0.0.1", Environment: "Production", Port: 80, TTL: 30, Expires: getExpirationTime(30)})
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	co := &dns.Conn{Conn: conn}
+	defer co.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("testservice.production.skydns.local.", dns.TypeA)
+	if err := co.WriteMsg(m); err != nil {
+		t.Fatal(err)
+	}
+	r, err := co.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 1 || !r.Answer[0].(*dns.A).A.Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatal("Query over TLS should be answered like over UDP and TCP", r.Answer)
+	}
+}
+
+func TestDNSOverHTTPS(t *testing.T) {
+	s := &Server{domain: "skydns.local", httpAddr: "127.0.0.1:8080", registry: registry.New(), forwarder: newForwarder(nil), stubs: newStubZones()}
+	s.registry.Add(msg.Service{UUID: "1", Name: "TestService", Version: "1.0.0", Region: "Test", Host: "10.0.0.1", Environment: "Production", Port: 80, TTL: 30, Expires: getExpirationTime(30)})
+
+	m := new(dns.Msg)
+	m.SetQuestion("testservice.production.skydns.local.", dns.TypeA)
+	m.Id = 0
+	buf, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(req *http.Request) {
+		rec := httptest.NewRecorder()
+		s.dnsQueryHTTPHandler(rec, req)
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != dohMediaType {
+			t.Fatalf("%s should return a DNS message, got %d", req.Method, rec.Code)
+		}
+		// The TTL counts down to the expiration of the service
+		if cc := rec.Header().Get("Cache-Control"); cc != "max-age=30" && cc != "max-age=29" {
+			t.Error("Cache-Control should use the TTL of the answer, got", rec.Header().Get("Cache-Control"))
+		}
+		r := new(dns.Msg)
+		if err := r.Unpack(rec.Body.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Answer) != 1 || !r.Answer[0].(*dns.A).A.Equal(net.ParseIP("10.0.0.1")) {
+			t.Fatal("Query over HTTPS should be answered like over UDP and TCP", r.Answer)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(buf), nil)
+	req.RemoteAddr = "127.0.0.1:40000"
+	check(req)
+
+	req, _ = http.NewRequest("POST", "/dns-query", bytes.NewReader(buf))
+	req.RemoteAddr = "127.0.0.1:40000"
+	req.Header.Set("Content-Type", dohMediaType)
+	check(req)
+
+	req, _ = http.NewRequest("POST", "/dns-query", bytes.NewReader(buf))
+	rec := httptest.NewRecorder()
+	s.dnsQueryHTTPHandler(rec, req)
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Fatal("POST without the DNS media type should fail")
+	}
+
+	req, _ = http.NewRequest("GET", "/dns-query?dns=AAAA", nil)
+	rec = httptest.NewRecorder()
+	s.dnsQueryHTTPHandler(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatal("An invalid query should fail")
+	}
+}
+
+func TestRecursionAllowed(t *testing.T) {
+	s := &Server{domain: "skydns.local", registry: registry.New(), forwarder: newForwarder([]string{"127.0.0.1:1"}), stubs: newStubZones()}
+	s.registry.Add(msg.Service{UUID: "1", Name: "TestService", Version: "1.0.0", Region: "Test", Host: "10.0.0.1", Environment: "Production", Port: 80, TTL: 30, Expires: getExpirationTime(30)})
+	_, allowed, _ := net.ParseCIDR("10.0.0.0/8")
+	s.SetRecursion([]*net.IPNet{allowed})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnsServer := &dns.Server{PacketConn: pc, Handler: s}
+	go dnsServer.ActivateAndServe()
+	defer dnsServer.Shutdown()
+
+	// We query from 127.0.0.1, which may not recurse
+	c := new(dns.Client)
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	r, _, err := c.Exchange(m, pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != dns.RcodeRefused || r.RecursionAvailable {
+		t.Fatal("Recursion should be refused")
+	}
+
+	m.SetQuestion("testservice.production.skydns.local.", dns.TypeA)
+	r, _, err = c.Exchange(m, pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 || r.RecursionAvailable {
+		t.Fatal("Our own names should be answered, without RA")
+	}
+
+	if !s.recursionAllowed(&dohWriter{remote: &net.TCPAddr{IP: net.ParseIP("10.1.2.3")}}) {
+		t.Fatal("Clients in the allowed networks should recurse")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	s := &Server{}
+	_, allowed, _ := net.ParseCIDR("10.0.0.0/8")
+	s.SetRateLimit(2, 1, 0, 2, []*net.IPNet{allowed})
+
+	answer := new(dns.Msg)
+	answer.SetQuestion("testservice.production.skydns.local.", dns.TypeA)
+	answer.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "testservice.production.skydns.local.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 30}, A: net.ParseIP("10.0.0.1")}}
+	nx := new(dns.Msg)
+	nx.SetQuestion("random.skydns.local.", dns.TypeA)
+	nx.Rcode = dns.RcodeNameError
+
+	client := &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 5000}
+	neighbour := &net.UDPAddr{IP: net.ParseIP("192.168.1.20"), Port: 5000}
+	expected := []int{rrlSend, rrlSend, rrlDrop, rrlSlip, rrlDrop, rrlSlip}
+	for i, e := range expected {
+		if a := s.rrl.check(client, answer); a != e {
+			t.Fatalf("Response %d should get action %d, got %d", i, e, a)
+		}
+	}
+	// The client network shares the limit
+	if s.rrl.check(neighbour, answer) == rrlSend {
+		t.Fatal("Clients in the same /24 should share the limit")
+	}
+	// Other response categories have their own limit
+	if s.rrl.check(client, nx) != rrlSend || s.rrl.check(client, nx) == rrlSend {
+		t.Fatal("NXDOMAIN responses should have a limit of 1")
+	}
+	if s.rrl.check(&net.UDPAddr{IP: net.ParseIP("192.168.2.10")}, answer) != rrlSend {
+		t.Fatal("Other networks should not be limited")
+	}
+	for i := 0; i < 10; i++ {
+		if s.rrl.check(&net.UDPAddr{IP: net.ParseIP("10.1.2.3")}, answer) != rrlSend {
+			t.Fatal("Allowed networks should never be limited")
+		}
+		if s.rrl.check(&net.TCPAddr{IP: net.ParseIP("192.168.1.10")}, answer) != rrlSend {
+			t.Fatal("TCP should never be limited")
+		}
+	}
+}
+
+// writeTestCertificate writes a self signed certificate and its key to dir.
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "skydns.local"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemFile, keyFile := dir+"/cert.pem", dir+"/key.pem"
+	if err := ioutil.WriteFile(pemFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return pemFile, keyFile
+}
+
+func TestVersionOffsets(t *testing.T) {
+	s := &Server{versionPriority: true}
+	offsets := s.versionOffsets([]msg.Service{
+		{UUID: "1", Version: "1.0.0"},
+		{UUID: "2", Version: "1.2.0"},
+		{UUID: "3", Version: "1.0"},
+		{UUID: "4", Version: "1.10.1"},
+		{UUID: "5", Version: "beta"},
+	})
+	expected := map[string]uint16{"1": 2, "2": 1, "3": 2, "4": 0, "5": 3}
+	for uuid, o := range expected {
+		if offsets[uuid] != o {
+			t.Errorf("Service %s should have a priority offset of %d, but has %d", uuid, o, offsets[uuid])
+		}
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	w := newWatcher()
+
+	events, next, notify, err := w.since(0, "*")
+	if err != nil || len(events) != 0 || next != 1 {
+		t.Fatal("A new watcher should not have any events")
+	}
+
+	w.publish(msg.Event{Index: 3, Type: msg.EventAdd, Service: services[0]})
+	w.publish(msg.Event{Index: 4, Type: msg.EventAdd, Service: services[1]})
+	w.publish(msg.Event{Index: 5, Type: msg.EventExpire, Service: services[0]})
+	select {
+	case <-notify:
+	default:
+		t.Fatal("Watchers should be notified of new events")
+	}
+
+	events, next, _, err = w.since(4, "development")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Index != 5 || events[0].Type != msg.EventExpire {
+		t.Fatal("Expected the expire event for the development environment", events)
+	}
+	if next != 6 {
+		t.Fatal("Expected to continue at index 6, not", next)
+	}
+
+	for i := uint64(6); i < 6+watchHistory; i++ {
+		w.publish(msg.Event{Index: i, Type: msg.EventUpdateTTL, Service: services[1]})
+	}
+	if _, _, _, err = w.since(5, "*"); err != errWatchCleared {
+		t.Fatal("Events before the history should be cleared")
+	}
+	if events, _, _, err = w.since(6, "*"); err != nil || len(events) != watchHistory {
+		t.Fatal("Events in the history should be returned", err, len(events))
+	}
+
+	// After a snapshot the events before it are gone
+	w.reset(2000)
+	if _, _, _, err = w.since(1500, "*"); err != errWatchCleared {
+		t.Fatal("Events before the snapshot should be cleared")
+	}
+	if _, next, _, err = w.since(0, "*"); err != nil || next != 2001 {
+		t.Fatal("Expected to continue after the snapshot, not", next, err)
+	}
+	w.recover()
+	if _, _, _, err = w.since(2001, "*"); err != errWatchCleared {
+		t.Fatal("Until the next event the snapshot index is not known")
+	}
+	w.publish(msg.Event{Index: 3000, Type: msg.EventAdd, Service: services[0]})
+	if _, _, _, err = w.since(2999, "*"); err != errWatchCleared {
+		t.Fatal("Events before the first event after the snapshot should be cleared")
+	}
+	if events, _, _, err = w.since(3000, "*"); err != nil || len(events) != 1 {
+		t.Fatal("Events after the snapshot should be returned", err, events)
+	}
+}
+
+func TestWatchWriteTimeout(t *testing.T) {
+	s := &Server{watch: newWatcher(), writeTimeout: 100 * time.Millisecond}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(s.watchHTTPHandler))
+	ts.Config.WriteTimeout = s.writeTimeout
+	ts.Start()
+	defer ts.Close()
+
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		s.watch.publish(msg.Event{Index: 7, Type: msg.EventAdd, Service: services[0]})
+	}()
+	resp, err := http.Get(ts.URL + "/skydns/watch/?index=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var events []msg.Event
+	if err := json.NewDecoder(resp.Body).Decode(&events); err != nil || len(events) != 1 || events[0].Index != 7 {
+		t.Fatal("A watch should outlast the write timeout", err, events)
+	}
+
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		s.watch.publish(msg.Event{Index: 8, Type: msg.EventRemove, Service: services[0]})
+	}()
+	req, _ := http.NewRequest("GET", ts.URL+"/skydns/watch/?index=8", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	stream, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Body.Close()
+	if stream.StatusCode != http.StatusOK || stream.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatal("Expected an event stream", stream.StatusCode, stream.Header)
+	}
+	line, err := bufio.NewReader(stream.Body).ReadString('\n')
+	if err != nil || line != "id: 8\n" {
+		t.Fatal("An event stream should outlast the write timeout", err, line)
+	}
+}
+
+func TestWatchHTTP(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	s.watch.publish(msg.Event{Index: 7, Type: msg.EventAdd, Service: services[1]})
+	s.watch.publish(msg.Event{Index: 8, Type: msg.EventRemove, Service: services[1]})
+
+	req, _ := http.NewRequest("GET", "/skydns/watch/?query=testservice.production&index=8", nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatal("Failed to watch services", resp.Code)
+	}
+
+	var events []msg.Event
+	if err := json.Unmarshal(resp.Body.Bytes(), &events); err != nil {
+		t.Fatal("Failed to unmarshal response from server")
+	}
+	if len(events) != 1 || events[0].Type != msg.EventRemove || events[0].Service.UUID != "101" {
+		t.Fatal("Expected the remove event for service 101", events)
+	}
+}
+
+func TestRunCheck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/health" {
+			http.NotFound(w, req)
+		}
+	}))
+	defer l.Close()
+
+	serv := msg.Service{UUID: "100", Host: "127.0.0.1", Check: &msg.Check{Type: msg.CheckTCP, Target: addr, Timeout: 1}}
+	if err := runCheck(serv); err != nil {
+		t.Fatal("TCP check should pass", err)
+	}
+	serv.Check = &msg.Check{Type: msg.CheckHTTP, Target: addr, Path: "/health", Timeout: 1}
+	if err := runCheck(serv); err != nil {
+		t.Fatal("HTTP check should pass", err)
+	}
+	serv.Check.Path = "/"
+	if err := runCheck(serv); err == nil {
+		t.Fatal("HTTP check should fail on a 404")
+	}
+	serv.Check.Type = "icmp"
+	if err := runCheck(serv); err != errCheckType {
+		t.Fatal("Unknown check types should fail")
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	servs := []msg.Service{
+		{UUID: "100"},
+		{UUID: "101", Health: &msg.Health{Healthy: false}},
+		{UUID: "102", Health: &msg.Health{Healthy: true}},
+	}
+	servs = healthy(servs)
+	if len(servs) != 2 || servs[0].UUID != "100" || servs[1].UUID != "102" {
+		t.Fatal("Unhealthy services should be removed", servs)
+	}
+}
+
+func TestTXTRecordsHealthy(t *testing.T) {
+	s := &Server{domain: "skydns.local", registry: registry.New()}
+	s.registry.Add(msg.Service{UUID: "105", Name: "TestService", Version: "1.0.0", Region: "East", Environment: "Production", Host: "10.0.0.5", Port: 80,
+		TTL: 30, Expires: getExpirationTime(30), Metadata: map[string]string{"shard": "1"}})
+	s.registry.Add(msg.Service{UUID: "106", Name: "TestService", Version: "1.0.0", Region: "East", Environment: "Production", Host: "10.0.0.6", Port: 80,
+		TTL: 30, Expires: getExpirationTime(30), Metadata: map[string]string{"shard": "2"}, Health: &msg.Health{Healthy: false}})
+
+	records, err := s.getTXTRecords(dns.Question{Name: "testservice.production.skydns.local.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET})
+	if err != nil || len(records) != 1 || records[0].(*dns.TXT).Txt[0] != "uuid=105" {
+		t.Fatal("Only the healthy service should have a TXT record", err, records)
+	}
+	records, _ = s.getTXTRecords(dns.Question{Name: "106.skydns.local.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET})
+	if len(records) != 0 {
+		t.Fatal("An unhealthy service should not have a TXT record", records)
+	}
+}
+
+func TestAddServiceBadCheck(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	m := msg.Service{
+		Name:        "TestService",
+		Version:     "1.0.0",
+		Region:      "Test",
+		Host:        "localhost",
+		Environment: "Production",
+		Port:        9000,
+		TTL:         4,
+		Check:       &msg.Check{Type: "icmp"},
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("PUT", "/skydns/services/123", bytes.NewBuffer(b))
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusBadRequest || s.registry.Len() != 0 {
+		t.Fatal("Services with an unknown check type should be refused", resp.Code)
+	}
+}
+
+func TestDNSUnhealthy(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	for _, m := range services {
+		s.registry.Add(m)
+	}
+	s.registry.SetHealth("101", msg.Health{Healthy: false, Output: "connection refused"})
+
+	c := new(dns.Client)
+	m := new(dns.Msg)
+	m.SetQuestion("testservice.production.skydns.local.", dns.TypeSRV)
+	resp, _, err := c.Exchange(m, "localhost:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 2 {
+		t.Fatal("Answer expected to have 2 SRV records but has", len(resp.Answer))
+	}
+	for _, a := range resp.Answer {
+		if a.(*dns.SRV).Target == "server2." {
+			t.Fatal("Unhealthy service should not be returned")
+		}
+	}
+}
+
+func TestDeliverer(t *testing.T) {
+	called := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		called <- req.Method + " " + req.URL.Path
+	}))
+	defer ts.Close()
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(ts.URL, "http://"))
+	p, _ := strconv.Atoi(port)
+
+	d := newDeliverer()
+	d.start()
+	d.enqueue(&delivery{Callback: msg.Callback{UUID: "101", Reply: host, Port: uint16(p)}, Event: msg.Event{Type: msg.EventRemove, Service: services[0]}})
+
+	select {
+	case c := <-called:
+		if c != "DELETE /skydns/callbacks/101" {
+			t.Fatal("Wrong callback performed:", c)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Callback not delivered")
+	}
+}
+
+func TestDelivererOrder(t *testing.T) {
+	called := make(chan string, 3)
+	failed := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// The first call fails, the calls after it must wait for its retry
+		if !failed {
+			failed = true
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		called <- req.Method
+	}))
+	defer ts.Close()
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(ts.URL, "http://"))
+	p, _ := strconv.Atoi(port)
+
+	d := newDeliverer()
+	d.start()
+	c := msg.Callback{UUID: "101", Reply: host, Port: uint16(p)}
+	for _, e := range []string{msg.EventAdd, msg.EventRemove, msg.EventAdd} {
+		d.enqueue(&delivery{Callback: c, Event: msg.Event{Type: e, Service: services[0]}})
+	}
+
+	for _, expected := range []string{"PUT", "DELETE", "PUT"} {
+		select {
+		case m := <-called:
+			if m != expected {
+				t.Fatalf("Wrong callback performed: %s, expected %s", m, expected)
+			}
+		case <-time.After(3 * deliveryBackoff):
+			t.Fatalf("Callback %s not delivered", expected)
+		}
+	}
+}
+
+func TestDelivererQueueFull(t *testing.T) {
+	d := newDeliverer() // not started, so nothing is taken from the queue
+	for i := 0; i <= deliveryQueue; i++ {
+		d.enqueue(&delivery{Callback: msg.Callback{UUID: strconv.Itoa(i)}, Event: msg.Event{Type: msg.EventRemove, Service: services[0]}})
+	}
+	if d.failed != 1 || len(d.failures) != 1 || d.failures[0].Error != errQueueFull.Error() {
+		t.Fatal("A full queue should record a failed callback")
+	}
+}
+
+func TestNSEC3(t *testing.T) {
+	s := &Server{domain: "skydns.local", domainLabels: 2, registry: registry.New()}
+	s.registry.DNSSEC(true)
+	s.SetNSEC3("aabb", 5)
+	for _, m := range services {
+		s.registry.Add(m)
+	}
+
+	// NXDOMAIN: the closest encloser, the next closer name and the wildcard
+	m := new(dns.Msg)
+	m.SetQuestion("foo.testservice.production.skydns.local.", dns.TypeSRV)
+	m.Rcode = dns.RcodeNameError
+	s.nsec(m)
+	var ce, nc, wc bool
+	for _, r := range m.Ns {
+		n := r.(*dns.NSEC3)
+		ce = ce || n.Match("testservice.production.skydns.local.")
+		nc = nc || n.Cover("foo.testservice.production.skydns.local.")
+		wc = wc || n.Cover("*.testservice.production.skydns.local.")
+	}
+	if !ce || !nc || !wc {
+		t.Fatalf("Closest encloser proof incomplete: %v %v %v", ce, nc, wc)
+	}
+
+	// NODATA: the NSEC3 matching the qname
+	m = new(dns.Msg)
+	m.SetQuestion("production.skydns.local.", dns.TypeA)
+	m.Ns = s.createSOA()
+	s.nsec(m)
+	if len(m.Ns) != 2 || !m.Ns[1].(*dns.NSEC3).Match("production.skydns.local.") {
+		t.Fatal("NODATA proof should have the matching NSEC3")
+	}
+	for _, typ := range m.Ns[1].(*dns.NSEC3).TypeBitMap {
+		if typ == dns.TypeA {
+			t.Fatal("NODATA proof should not have the type of the question")
+		}
+	}
+
+	// NODATA for a name that is not hashed: an NSEC3 matching only qname
+	m = new(dns.Msg)
+	m.SetQuestion("east.*.testservice.production.skydns.local.", dns.TypeAAAA)
+	m.Ns = s.createSOA()
+	s.nsec(m)
+	if len(m.Ns) != 2 || !m.Ns[1].(*dns.NSEC3).Match("east.*.testservice.production.skydns.local.") {
+		t.Fatal("NODATA proof should have an NSEC3 matching the qname", m.Ns)
+	}
+	if nextHash("0uv") != "0v0" || nextHash("vvv") != "000" {
+		t.Fatal("Wrong next hash", nextHash("0uv"), nextHash("vvv"))
+	}
+}
+
+func TestNSEC3Signatures(t *testing.T) {
+	s := &Server{domain: "skydns.local", domainLabels: 2, registry: registry.New(), sigs: newSigCache(100)}
+	s.registry.DNSSEC(true)
+	s.SetNSEC3("aabb", 5)
+	for _, m := range services {
+		s.registry.Add(m)
+	}
+	s.SetKeyManagement("ECDSAP256SHA256", 24*time.Hour, time.Hour)
+	now := time.Now().UTC()
+	keys, _, err := s.rollKeys(nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.registry.SetKeys(keys)
+	zk := s.zoneKeys(now)
+
+	// The NODATA proofs for the same name differ in their type bitmap, both
+	// must have their own signature.
+	for _, qtype := range []uint16{dns.TypeTXT, dns.TypeAAAA, dns.TypeTXT} {
+		m := new(dns.Msg)
+		m.SetQuestion("production.skydns.local.", qtype)
+		m.Ns = s.createSOA()
+		s.nsec(m)
+		s.sign(m, zk)
+		var nsec3 []dns.RR
+		var sig *dns.RRSIG
+		for _, r := range m.Ns {
+			switch r := r.(type) {
+			case *dns.NSEC3:
+				nsec3 = append(nsec3, r)
+			case *dns.RRSIG:
+				if r.TypeCovered == dns.TypeNSEC3 {
+					sig = r
+				}
+			}
+		}
+		if len(nsec3) != 1 || sig == nil {
+			t.Fatal("NODATA proof should have a signed NSEC3", m.Ns)
+		}
+		if err := sig.Verify(zk.zsk[0].dnskey, nsec3); err != nil {
+			t.Fatalf("NSEC3 for %s not signed: %s", dns.TypeToString[qtype], err)
+		}
+	}
+}
+
+func TestKeyAlgorithms(t *testing.T) {
+	for alg := range keyAlgorithms {
+		s := &Server{domain: "skydns.local", domainLabels: 2, registry: registry.New(), sigs: newSigCache(100)}
+		if err := s.SetKeyManagement(alg, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now().UTC()
+		keys, _, err := s.rollKeys(nil, now)
+		if err != nil {
+			t.Fatalf("%s keys not generated: %s", alg, err)
+		}
+		s.registry.SetKeys(keys)
+		zk := s.zoneKeys(now)
+		if zk == nil || zk.zsk[0].dnskey.Algorithm != keyAlgorithms[alg] {
+			t.Fatalf("%s keys should sign", alg)
+		}
+
+		m := new(dns.Msg)
+		m.SetQuestion("db.skydns.local.", dns.TypeA)
+		m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: "db.skydns.local.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 30}, A: net.ParseIP("10.0.0.1")})
+		s.sign(m, zk)
+		if len(m.Answer) != 2 {
+			t.Fatalf("%s should sign the A RRset", alg)
+		}
+		if err := m.Answer[1].(*dns.RRSIG).Verify(zk.zsk[0].dnskey, m.Answer[:1]); err != nil {
+			t.Fatalf("%s signature does not verify: %s", alg, err)
+		}
+	}
+}
+
+func TestKeyRollover(t *testing.T) {
+	s := &Server{domain: "skydns.local", domainLabels: 2, registry: registry.New(), sigs: newSigCache(100)}
+	if err := s.SetKeyManagement("ecdsap256sha256", 24*time.Hour, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetKeyManagement("RSASHA1", 0, 0); err != ErrKeyAlgorithm {
+		t.Fatal("RSASHA1 keys should not be generated")
+	}
+	s.SetKeyManagement("ECDSAP256SHA256", 24*time.Hour, time.Hour)
+	if s.zoneKeys(time.Now()) != nil {
+		t.Fatal("Replies should not be signed before the keys are generated")
+	}
+
+	now := time.Now().UTC()
+	keys, changed, err := s.rollKeys(nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed || len(keys) != 2 || keys[0].KSK == keys[1].KSK {
+		t.Fatal("A KSK and a ZSK should be generated", keys)
+	}
+	if _, changed, _ := s.rollKeys(keys, now.Add(time.Hour)); changed {
+		t.Fatal("The keys should not change before the ZSK lifetime")
+	}
+	s.registry.SetKeys(keys)
+	zk := s.zoneKeys(now)
+	if zk == nil || len(zk.published) != 2 || len(zk.ksk) != 1 || len(zk.zsk) != 1 {
+		t.Fatal("Both keys should be published and active")
+	}
+	if zk.ksk[0].dnskey.Flags != 257 || zk.zsk[0].dnskey.Flags != 256 {
+		t.Fatal("Only the KSK should have the SEP flag")
+	}
+
+	// The DNSKEY RRset is signed by the KSK, other RRsets by the ZSK
+	m := new(dns.Msg)
+	m.SetQuestion("skydns.local.", dns.TypeDNSKEY)
+	for _, k := range zk.published {
+		m.Answer = append(m.Answer, k)
+	}
+	a := &dns.A{Hdr: dns.RR_Header{Name: "db.skydns.local.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 30}, A: net.ParseIP("10.0.0.1")}
+	m.Ns = append(m.Ns, a)
+	s.sign(m, zk)
+	if len(m.Answer) != 3 || len(m.Ns) != 2 {
+		t.Fatal("Every RRset should have one signature")
+	}
+	if err := m.Answer[2].(*dns.RRSIG).Verify(zk.ksk[0].dnskey, m.Answer[:2]); err != nil {
+		t.Fatal("DNSKEY RRset not signed by the KSK:", err)
+	}
+	if err := m.Ns[1].(*dns.RRSIG).Verify(zk.zsk[0].dnskey, m.Ns[:1]); err != nil {
+		t.Fatal("A RRset not signed by the ZSK:", err)
+	}
+
+	// The DS, CDS and CDNSKEY of the KSK for the parent zone
+	w := httptest.NewRecorder()
+	s.getKeysHTTPHandler(w, nil)
+	var reply struct {
+		DNSKEY, DS, CDS, CDNSKEY []string
+	}
+	if err := json.NewDecoder(w.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.DNSKEY) != 2 || len(reply.DS) != 1 || len(reply.CDS) != 1 || len(reply.CDNSKEY) != 1 {
+		t.Fatal("DS records of the KSK expected", reply)
+	}
+	if !strings.Contains(reply.CDS[0], "CDS") || !strings.Contains(reply.CDNSKEY[0], "257 3 13") {
+		t.Fatal("Wrong CDS or CDNSKEY", reply)
+	}
+
+	// After the lifetime a new ZSK is pre-published
+	old := zk.zsk[0].tag
+	later := now.Add(25 * time.Hour)
+	keys, changed, err = s.rollKeys(keys, later)
+	if err != nil || !changed || len(keys) != 3 {
+		t.Fatal("A new ZSK should be published", err)
+	}
+	s.registry.SetKeys(keys)
+	zk = s.zoneKeys(later)
+	if len(zk.published) != 3 || len(zk.zsk) != 1 || zk.zsk[0].tag != old {
+		t.Fatal("The old ZSK should sign until the new one is active")
+	}
+	zk = s.zoneKeys(later.Add(time.Hour))
+	if len(zk.published) != 3 || len(zk.zsk) != 1 || zk.zsk[0].tag == old {
+		t.Fatal("The new ZSK should sign once active, the old one should still be published")
+	}
+	keys, changed, _ = s.rollKeys(keys, later.Add(2*time.Hour))
+	if !changed || len(keys) != 2 {
+		t.Fatal("The old ZSK should be removed", len(keys))
+	}
+}
+
+func TestSignatureCache(t *testing.T) {
+	a1 := &dns.A{Hdr: dns.RR_Header{Name: "db.skydns.local.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 30}, A: net.ParseIP("10.0.0.1")}
+	a2 := &dns.A{Hdr: dns.RR_Header{Name: "db.skydns.local.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 30}, A: net.ParseIP("10.0.0.2")}
+	if sigKey([]dns.RR{a1, a2}, 1) != sigKey([]dns.RR{a2, a1}, 1) {
+		t.Fatal("The order of the records should not matter")
+	}
+	if sigKey([]dns.RR{a1, a2}, 1) == sigKey([]dns.RR{a1, a2}, 2) {
+		t.Fatal("Signatures of different keys should have different keys")
+	}
+
+	c := newSigCache(2)
+	c.insert("a", new(dns.RRSIG))
+	c.insert("b", new(dns.RRSIG))
+	c.search("a")
+	evictions := stats.SignatureCacheEvictCount.Count()
+	c.insert("c", new(dns.RRSIG))
+	if c.search("b") != nil || c.search("a") == nil || c.search("c") == nil {
+		t.Fatal("The least recently used signature should be evicted")
+	}
+	if stats.SignatureCacheEvictCount.Count() != evictions+1 {
+		t.Fatal("Eviction not counted")
+	}
+	c.remove("a")
+	if c.search("a") != nil || c.lru.Len() != 1 {
+		t.Fatal("Signature not removed")
+	}
+
+	s := &Server{domain: "skydns.local", domainLabels: 2, registry: registry.New(), sigs: newSigCache(100)}
+	s.SetKeyManagement("ECDSAP256SHA256", 0, 0)
+	now := time.Now().UTC()
+	keys, _, err := s.rollKeys(nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.registry.SetKeys(keys)
+	zk := s.zoneKeys(now)
+
+	first := s.signatures([]dns.RR{a1, a2}, zk, now)
+	misses := stats.SignatureCacheMissCount.Count()
+	second := s.signatures([]dns.RR{a2, a1}, zk, now)
+	if len(first) != 1 || len(second) != 1 || stats.SignatureCacheMissCount.Count() != misses {
+		t.Fatal("The signature should be cached")
+	}
+	if first[0].(*dns.RRSIG).Signature != second[0].(*dns.RRSIG).Signature {
+		t.Fatal("The cached signature should be used")
+	}
+	// Signatures that are about to expire are replaced
+	third := s.signatures([]dns.RR{a1, a2}, zk, now.Add(sigValidity-time.Hour))
+	if first[0].(*dns.RRSIG).Expiration == third[0].(*dns.RRSIG).Expiration {
+		t.Fatal("The signature should be replaced before it expires")
+	}
+}
+
+func TestFit(t *testing.T) {
+	newReply := func() *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("testservice.production.skydns.local.", dns.TypeSRV)
+		for i := 0; i < 20; i++ {
+			target := "server" + strconv.Itoa(i) + ".testservice.production.skydns.local."
+			m.Answer = append(m.Answer, &dns.SRV{Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 30}, Priority: 10, Weight: 5, Port: 80, Target: target})
+			m.Extra = append(m.Extra, &dns.A{Hdr: dns.RR_Header{Name: target, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 30}, A: net.ParseIP("10.0.0.1")})
+		}
+		return m
+	}
+
+	m := newReply()
+	fit(m, dns.MaxMsgSize)
+	if len(m.Answer) != 20 || len(m.Extra) != 20 || m.Truncated || !m.Compress {
+		t.Fatal("A reply that fits should only be compressed")
+	}
+
+	// The additional section goes first
+	m = newReply()
+	m.SetEdns0(4096, false)
+	fit(m, 1400)
+	if len(m.Answer) != 20 || len(m.Extra) != 1 || m.IsEdns0() == nil || m.Truncated {
+		t.Fatal("Only the OPT record should be kept in the additional section", len(m.Answer), len(m.Extra))
+	}
+
+	m = newReply()
+	fit(m, dns.MinMsgSize)
+	if !m.Truncated || len(m.Answer) == 0 || len(m.Answer) == 20 || len(m.Extra) != 0 {
+		t.Fatal("The reply should be truncated", len(m.Answer))
+	}
+	if l := m.Len(); l > dns.MinMsgSize {
+		t.Fatal("The reply does not fit:", l)
+	}
+
+	// Without EDNS0 UDP replies are limited to 512 bytes
+	req := new(dns.Msg)
+	req.SetQuestion("testservice.production.skydns.local.", dns.TypeSRV)
+	udp := &dohWriter{remote: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000}}
+	if maxSize(udp, req) != dns.MinMsgSize {
+		t.Fatal("Wrong size without EDNS0")
+	}
+	req.SetEdns0(1232, false)
+	if maxSize(udp, req) != 1232 {
+		t.Fatal("The EDNS0 buffer size should be used")
+	}
+	if maxSize(&dohWriter{remote: &net.TCPAddr{}}, req) != dns.MaxMsgSize {
+		t.Fatal("Replies over TCP should not be limited")
+	}
+	r := new(dns.Msg)
+	setEdns0(r, req)
+	if r.IsEdns0() == nil {
+		t.Fatal("The reply to an EDNS0 request should have an OPT record")
+	}
+}
+
+func TestAnswerLimit(t *testing.T) {
+	s := &Server{domain: "skydns.local", domainLabels: 2, registry: registry.New()}
+	for i := 0; i < 10; i++ {
+		s.registry.Add(msg.Service{UUID: "20" + strconv.Itoa(i), Name: "web", Version: "1", Region: "east", Host: "10.0.0." + strconv.Itoa(i+1),
+			Environment: "production", Port: 80, TTL: 30, Expires: getExpirationTime(30)})
+	}
+	s.SetAnswerLimit(3, false)
+
+	q := dns.Question{Name: "web.production.skydns.local.", Qtype: dns.TypeSRV, Qclass: dns.ClassINET}
+	records, extra, err := s.getSRVRecords(q, "", nil)
+	if err != nil || len(records) != 10 || len(extra) != 10 {
+		t.Fatal("All services expected", err)
+	}
+	records, extra = s.limitSRV(records, extra)
+	if len(records) != 3 || len(extra) != 3 {
+		t.Fatal("The answer should be limited", len(records), len(extra))
+	}
+	for i, r := range records {
+		if r.(*dns.SRV).Target != extra[i].Header().Name {
+			t.Fatal("The additional section should only have the targets of the answer")
+		}
+	}
+	q.Qtype = dns.TypeA
+	records, _ = s.getARecords(q, "", nil, true)
+	if len(s.limitAnswer(records)) != 3 {
+		t.Fatal("The A records should be limited")
+	}
+
+	// Sorted on priority, then shuffled by weight
+	srv := func(priority, weight uint16, target string) dns.RR {
+		return &dns.SRV{Hdr: dns.RR_Header{Name: "web.skydns.local.", Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 30},
+			Priority: priority, Weight: weight, Port: 80, Target: target}
+	}
+	s.roundrobin = true
+	heavy := 0
+	for i := 0; i < 1000; i++ {
+		records := []dns.RR{srv(20, 50, "backup."), srv(10, 0, "zero."), srv(10, 10, "light."), srv(10, 90, "heavy.")}
+		s.orderSRV(records, nil)
+		if records[2].(*dns.SRV).Target != "zero." || records[3].(*dns.SRV).Target != "backup." {
+			t.Fatal("Records should be sorted on priority, weight 0 last", records)
+		}
+		if records[0].(*dns.SRV).Target == "heavy." {
+			heavy++
+		}
+	}
+	if heavy < 800 || heavy > 970 {
+		t.Fatal("The heavy record should come first about 90% of the time, not", heavy)
+	}
+
+	// Sticky clients get the same order every time
+	s.SetAnswerLimit(3, true)
+	q.Qtype = dns.TypeSRV
+	firsts := make(map[string]bool)
+	for i := 1; i < 20; i++ {
+		client := net.ParseIP("192.168.0." + strconv.Itoa(i))
+		a, _, _ := s.getSRVRecords(q, "", client)
+		b, _, _ := s.getSRVRecords(q, "", client)
+		for j := range a {
+			if a[j].(*dns.SRV).Target != b[j].(*dns.SRV).Target {
+				t.Fatal("A sticky client should get the same records")
+			}
+		}
+		firsts[a[0].(*dns.SRV).Target] = true
+	}
+	if len(firsts) < 2 {
+		t.Fatal("Different clients should get different records")
+	}
+
+	// Signed replies get the same records without stickiness, but in a
+	// random order
+	s.SetAnswerLimit(3, false)
+	targets := func(records []dns.RR) []string {
+		var t []string
+		for _, r := range records {
+			t = append(t, r.(*dns.SRV).Target)
+		}
+		return t
+	}
+	a, _, _ := s.getSRVRecords(q, "", everyone)
+	kept := targets(a[:3])
+	sort.Strings(kept)
+	firsts = make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		b, _, _ := s.getSRVRecords(q, "", everyone)
+		got := targets(b[:3])
+		firsts[got[0]] = true
+		sort.Strings(got)
+		if strings.Join(got, " ") != strings.Join(kept, " ") {
+			t.Fatal("Every client should get the same records", got, kept)
+		}
+	}
+	if len(firsts) != 3 {
+		t.Fatal("Every record should come first some of the time", firsts)
+	}
+}
+
+func TestHostnameServices(t *testing.T) {
+	s := &Server{domain: "skydns.local", domainLabels: 2, registry: registry.New(), forwarder: newForwarder(nil), stubs: newStubZones(), sigs: newSigCache(100)}
+	add := func(uuid, name, host string) {
+		s.registry.Add(msg.Service{UUID: uuid, Name: name, Version: "1", Region: "east", Host: host,
+			Environment: "production", Port: 80, TTL: 30, Expires: getExpirationTime(30)})
+	}
+	add("301", "db", "10.0.0.1")
+	add("302", "db", "10.0.0.2")
+	add("303", "web", "DB.production.skydns.local")
+	add("304", "web", "db.production.skydns.local.")
+
+	// A single hostname in our domain: a CNAME and the addresses from the registry
+	q := dns.Question{Name: "web.production.skydns.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	records, err := s.getARecords(q, "", nil, true)
+	if err != nil || len(records) != 3 {
+		t.Fatal("Expected a CNAME and two A records", err, records)
+	}
+	cname, ok := records[0].(*dns.CNAME)
+	if !ok || cname.Hdr.Name != q.Name || cname.Target != "db.production.skydns.local." {
+		t.Fatal("Expected a CNAME to the hostname", records[0])
+	}
+	for _, r := range records[1:] {
+		if r.Header().Rrtype != dns.TypeA || r.Header().Name != cname.Target {
+			t.Fatal("Expected the A records of the hostname", r)
+		}
+	}
+
+	// Next to an address the hostname is flattened
+	add("305", "web", "10.0.0.3")
+	records, _ = s.getARecords(q, "", nil, true)
+	if len(records) != 3 {
+		t.Fatal("Expected three A records", records)
+	}
+	for _, r := range records {
+		if r.Header().Rrtype != dns.TypeA || r.Header().Name != q.Name {
+			t.Fatal("Expected only A records for the name", r)
+		}
+	}
+	// Also for AAAA, the name has IPv4 addresses so it can not be a CNAME
+	q.Qtype = dns.TypeAAAA
+	records, _ = s.getARecords(q, "", nil, true)
+	if len(records) != 0 {
+		t.Fatal("Expected no records", records)
+	}
+	q.Qtype = dns.TypeA
+
+	// Outside our domain without nameservers: only the CNAME, which is signed
+	// while the record of the target is not
+	add("306", "api", "api.example.org")
+	q.Name = "api.production.skydns.local."
+	records, _ = s.getARecords(q, "", nil, true)
+	if len(records) != 1 || records[0].(*dns.CNAME).Target != "api.example.org." {
+		t.Fatal("Expected only a CNAME", records)
+	}
+	s.SetKeyManagement("ECDSAP256SHA256", 0, 0)
+	now := time.Now().UTC()
+	keys, _, err := s.rollKeys(nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.registry.SetKeys(keys)
+	external := &dns.A{Hdr: dns.RR_Header{Name: "api.example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 30}, A: net.ParseIP("192.0.2.1")}
+	sigs := s.signatures(append(records, external), s.zoneKeys(now), now)
+	if len(sigs) != 1 || sigs[0].(*dns.RRSIG).TypeCovered != dns.TypeCNAME {
+		t.Fatal("Only the CNAME should be signed", sigs)
+	}
+
+	// Several hostnames outside our domain: a CNAME to one of them
+	add("307", "api", "api2.example.org")
+	records, _ = s.getARecords(q, "", nil, true)
+	if len(records) != 1 || records[0].Header().Rrtype != dns.TypeCNAME {
+		t.Fatal("Expected a single CNAME", records)
+	}
+
+	// The nameservers are only asked when the client may recurse
+	queried := make(chan string, 10)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		queried <- req.Question[0].Name
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 30}, A: net.ParseIP("192.0.2.1")})
+		w.WriteMsg(m)
+	})}
+	go upstream.ActivateAndServe()
+	defer upstream.Shutdown()
+	s.forwarder = newForwarder([]string{pc.LocalAddr().String()})
+	records, _ = s.getARecords(q, "", nil, false)
+	if len(records) != 1 || len(queried) != 0 {
+		t.Fatal("Without recursion only the CNAME is expected", records)
+	}
+	records, _ = s.getARecords(q, "", nil, true)
+	if len(records) != 2 || records[1].Header().Name != records[0].(*dns.CNAME).Target {
+		t.Fatal("Expected the CNAME and the address of its target", records)
+	}
+
+	// Next to an address the hostnames outside our domain are left out, their
+	// addresses are not ours
+	add("308", "api", "10.0.0.8")
+	records, _ = s.getARecords(q, "", nil, true)
+	if len(records) != 1 || records[0].(*dns.A).A.String() != "10.0.0.8" {
+		t.Fatal("Expected only the address of the service", records)
+	}
+}
+
+func TestZoneTransfer(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	for _, m := range services {
+		s.registry.Add(m)
+	}
+
+	m := new(dns.Msg)
+	m.SetAxfr("skydns.local.")
+	c := &dns.Client{Net: "tcp"}
+	resp, _, err := c.Exchange(m, "localhost:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dns.RcodeRefused {
+		t.Fatal("Zone transfer should be refused without -transfer")
+	}
+
+	_, lo, _ := net.ParseCIDR("127.0.0.0/8")
+	s.SetTransfer([]*net.IPNet{lo}, nil)
+	tr := new(dns.Transfer)
+	env, err := tr.In(m, "127.0.0.1:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rrs []dns.RR
+	for e := range env {
+		if e.Error != nil {
+			t.Fatal(e.Error)
+		}
+		rrs = append(rrs, e.RR...)
+	}
+	if len(rrs) < 3 || rrs[0].Header().Rrtype != dns.TypeSOA || rrs[len(rrs)-1].Header().Rrtype != dns.TypeSOA {
+		t.Fatal("Zone transfer should start and end with the SOA")
+	}
+	want := 0
+	for _, m := range services {
+		if strings.ToLower(m.Name) == "testservice" && strings.ToLower(m.Environment) == "production" {
+			want++
+		}
+	}
+	srv := 0
+	for _, r := range rrs {
+		if r.Header().Name == "testservice.production.skydns.local." && r.Header().Rrtype == dns.TypeSRV {
+			srv++
+		}
+	}
+	if srv != want {
+		t.Fatalf("Zone should have %d SRV records for testservice.production.skydns.local., got %d", want, srv)
+	}
+}
+
+func TestZoneTTL(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	s.registry.Add(msg.Service{UUID: "401", Name: "db", Version: "1", Region: "east", Host: "10.0.0.1",
+		Environment: "production", Port: 80, TTL: 30, Expires: getExpirationTime(10)})
+	for _, r := range s.zone(s.serial()) {
+		if r.Header().Rrtype != dns.TypeNS && r.Header().Name != "master.skydns.local." && r.Header().Ttl != zoneTTL {
+			t.Fatal("Service records should not count down in the zone", r)
+		}
+	}
+}
+
+func TestZoneHealthy(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	s.registry.Add(msg.Service{UUID: "402", Name: "db", Version: "1", Region: "east", Host: "10.0.0.2", Environment: "production", Port: 80,
+		TTL: 30, Expires: getExpirationTime(30), Metadata: map[string]string{"shard": "1"}, Health: &msg.Health{Healthy: false}})
+	for _, r := range s.zone(s.serial()) {
+		if strings.HasSuffix(r.Header().Name, "production.skydns.local.") || r.Header().Name == "402.skydns.local." {
+			t.Fatal("An unhealthy service should not be in the zone", r)
+		}
+	}
+}
+
+func TestZoneDiff(t *testing.T) {
+	a1, _ := dns.NewRR("a.skydns.local. 30 IN A 10.0.0.1")
+	a2, _ := dns.NewRR("a.skydns.local. 30 IN A 10.0.0.2")
+	a3, _ := dns.NewRR("a.skydns.local. 60 IN A 10.0.0.2")
+
+	deleted, added := zoneDiff([]dns.RR{a1, a2}, []dns.RR{a1, a3})
+	if len(deleted) != 1 || deleted[0] != a2 {
+		t.Fatal("Wrong records deleted", deleted)
+	}
+	if len(added) != 1 || added[0] != a3 {
+		t.Fatal("Wrong records added", added)
+	}
+
+	z := newZoneHistory()
+	for i := uint32(0); i <= transferHistory; i++ {
+		z.add(i, []dns.RR{a1})
+	}
+	if _, ok := z.get(0); ok {
+		t.Fatal("Oldest zone should have been removed")
+	}
+	if _, ok := z.get(transferHistory); !ok {
+		t.Fatal("Newest zone should be kept")
+	}
+}
+
+func TestSerial(t *testing.T) {
+	s := &Server{domain: "skydns.local", registry: registry.New(), notifyPending: make(chan bool, 1)}
+	serial := s.createSOA()[0].(*dns.SOA).Serial
+	// Above the time based serials of older versions, RFC 1982
+	if old := uint32(1400000000); serial-old >= 1<<31 {
+		t.Fatal("Serial should be above the time based serials", serial, old)
+	}
+	s.registry.SetIndex(10)
+	if s.createSOA()[0].(*dns.SOA).Serial != serial+10 {
+		t.Fatal("Serial should follow the raft index")
+	}
+	// An older index must not decrease the serial
+	s.registry.SetIndex(5)
+	if s.createSOA()[0].(*dns.SOA).Serial != serial+10 {
+		t.Fatal("Serial should not decrease")
+	}
+}
+
+func TestNotify(t *testing.T) {
+	notified := make(chan *dns.Msg, 1)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondary := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		w.WriteMsg(m)
+		notified <- req
+	})}
+	go secondary.ActivateAndServe()
+	defer secondary.Shutdown()
+
+	s := &Server{domain: "skydns.local", registry: registry.New()}
+	s.registry.SetIndex(42)
+	s.sendNotify(pc.LocalAddr().String(), s.createSOA())
+
+	select {
+	case req := <-notified:
+		if req.Opcode != dns.OpcodeNotify || req.Question[0].Name != "skydns.local." {
+			t.Fatal("Secondary did not get a NOTIFY for skydns.local.")
+		}
+		if len(req.Answer) != 1 || req.Answer[0].(*dns.SOA).Serial != serialBase+42 {
+			t.Fatal("NOTIFY should have the SOA with the current serial")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Secondary was not notified")
+	}
+}
+
+func TestClientRegion(t *testing.T) {
+	s := &Server{domain: "skydns.local", registry: registry.New()}
+	if err := s.SetRegionNetworks(map[string]string{"127.0.0.0/8": "Central", "10.0.0.0/8": "east", "10.2.0.0/16": "west"}); err != nil {
+		t.Fatal(err)
+	}
+	for i, region := range []string{"East", "Central", "West"} {
+		s.registry.Add(msg.Service{UUID: strconv.Itoa(i), Name: "TestService", Version: "1.0.0", Region: region, Host: "10.0.0." + strconv.Itoa(i+1), Environment: "Production", Port: 80, TTL: 30, Expires: getExpirationTime(30)})
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnsServer := &dns.Server{PacketConn: pc, Handler: s}
+	go dnsServer.ActivateAndServe()
+	defer dnsServer.Shutdown()
+
+	c := new(dns.Client)
+	query := func(name string, qtype uint16, subnet string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		if subnet != "" {
+			ip, n, _ := net.ParseCIDR(subnet)
+			ones, _ := n.Mask.Size()
+			o := new(dns.OPT)
+			o.Hdr.Name = "."
+			o.Hdr.Rrtype = dns.TypeOPT
+			o.Option = append(o.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: uint8(ones), Address: ip})
+			m.Extra = append(m.Extra, o)
+		}
+		r, _, err := c.Exchange(m, pc.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	priorities := func(r *dns.Msg) map[string]uint16 {
+		p := make(map[string]uint16)
+		for _, rr := range r.Answer {
+			srv := rr.(*dns.SRV)
+			p[srv.Target] = srv.Priority
+		}
+		return p
+	}
+
+	// The address of the client (127.0.0.1) is in central
+	p := priorities(query("testservice.production.skydns.local.", dns.TypeSRV, ""))
+	if p["1.skydns.local."] != 10 || p["0.skydns.local."] != 20 || p["2.skydns.local."] != 20 {
+		t.Fatal("Services in the region of the client should get priority 10", p)
+	}
+
+	// The client subnet takes precedence, the most specific network wins
+	r := query("testservice.production.skydns.local.", dns.TypeSRV, "10.2.3.0/24")
+	p = priorities(r)
+	if p["2.skydns.local."] != 10 || p["0.skydns.local."] != 20 || p["1.skydns.local."] != 20 {
+		t.Fatal("Services in the region of the client subnet should get priority 10", p)
+	}
+	opt := r.IsEdns0()
+	if opt == nil || len(opt.Option) != 1 || opt.Option[0].(*dns.EDNS0_SUBNET).SourceScope != 24 {
+		t.Fatal("The reply should have the client subnet with scope 24")
+	}
+
+	// A subnet without a region still scopes the reply, other subnets may have one
+	r = query("testservice.production.skydns.local.", dns.TypeSRV, "192.168.1.0/24")
+	if opt := r.IsEdns0(); opt == nil || len(opt.Option) != 1 || opt.Option[0].(*dns.EDNS0_SUBNET).SourceScope != 24 {
+		t.Fatal("The reply for a subnet without a region should have scope 24")
+	}
+
+	// A region in the query takes precedence
+	r = query("east.*.testservice.production.skydns.local.", dns.TypeSRV, "10.2.3.0/24")
+	p = priorities(r)
+	if p["0.skydns.local."] != 10 || p["2.skydns.local."] != 20 {
+		t.Fatal("The region in the query should get priority 10", p)
+	}
+	if opt := r.IsEdns0(); opt == nil || len(opt.Option) != 1 || opt.Option[0].(*dns.EDNS0_SUBNET).SourceScope != 0 {
+		t.Fatal("The reply for a query with a region should have scope 0")
+	}
+
+	// A records of the region of the client come first
+	r = query("testservice.production.skydns.local.", dns.TypeA, "10.1.0.0/16")
+	if len(r.Answer) != 3 || !r.Answer[0].(*dns.A).A.Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatal("The A record in the region of the client should come first", r.Answer)
+	}
+}
+
+func TestReverseIP(t *testing.T) {
+	tests := map[string]string{
+		"2.0.0.10.in-addr.arpa.": "10.0.0.2",
+		"0.0.10.in-addr.arpa.":   "",
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.": "2001:db8::1",
+		"8.b.d.0.1.0.0.2.ip6.arpa.": "",
+	}
+	for name, expected := range tests {
+		ip := reverseIP(name)
+		if expected == "" {
+			if ip != nil {
+				t.Errorf("%s should not be an address, got %s", name, ip)
+			}
+			continue
+		}
+		if !ip.Equal(net.ParseIP(expected)) {
+			t.Errorf("%s should be %s, got %s", name, expected, ip)
+		}
+	}
+}
+
+func TestPTRRecords(t *testing.T) {
+	s := &Server{domain: "skydns.local", registry: registry.New()}
+	s.SetReverse([]string{"10.in-addr.arpa"}, true)
+	s.registry.Add(msg.Service{UUID: "101", Name: "TestService", Version: "1.0.0", Region: "East", Environment: "Production", Host: "10.0.0.2", Port: 80, TTL: 30})
+	s.registry.Add(msg.Service{UUID: "102", Name: "TestService", Version: "1.0.0", Region: "East", Environment: "Production", Host: "10.0.0.2", Port: 81, TTL: 30})
+	s.registry.Add(msg.Service{UUID: "103", Name: "TestService", Version: "1.0.0", Region: "East", Environment: "Production", Host: "10.0.0.3", Port: 80, TTL: 30})
+	s.registry.Add(msg.Service{UUID: "104", Name: "OtherService", Version: "1.0.0", Region: "East", Environment: "Production", Host: "10.0.0.2", Port: 82, TTL: 30,
+		Health: &msg.Health{Healthy: false}})
+
+	if s.reverseZone("2.0.0.10.in-addr.arpa.") != "10.in-addr.arpa." || s.reverseZone("2.0.0.11.in-addr.arpa.") != "" {
+		t.Fatal("Wrong reverse zone")
+	}
+	q := dns.Question{Name: "2.0.0.10.in-addr.arpa.", Qtype: dns.TypePTR, Qclass: dns.ClassINET}
+	records := s.getPTRRecords(q, reverseIP(q.Name))
+	expected := map[string]bool{"101.skydns.local.": true, "102.skydns.local.": true, "east.1-0-0.testservice.production.skydns.local.": true}
+	if len(records) != len(expected) {
+		t.Fatalf("Expected %d PTR records, got %d", len(expected), len(records))
+	}
+	for _, r := range records {
+		if !expected[r.(*dns.PTR).Ptr] {
+			t.Fatal("Unexpected PTR record", r)
+		}
+	}
+}
+
+func TestWeights(t *testing.T) {
+	s := &Server{domain: "skydns.local", registry: registry.New(), loadTimeout: loadTimeout}
+	services := []msg.Service{
+		{UUID: "1", Host: "web1"},
+		{UUID: "2", Host: "web2"},
+		{UUID: "3", Host: "web3"},
+	}
+
+	w := s.weights(services)
+	if w["1"] != 33 || w["2"] != 33 || w["3"] != 33 {
+		t.Fatal("Without load reports the weight should be divided equally", w)
+	}
+
+	busy, idle := 0.2, 0.6
+	s.registry.SetLoad("web1", msg.Load{CPUIdle: &busy, Reported: time.Now()})
+	s.registry.SetLoad("web2", msg.Load{CPUIdle: &idle, Reported: time.Now()})
+	// web3 has not reported and gets the average headroom: 0.4
+	w = s.weights(services)
+	if w["1"] != 17 || w["2"] != 50 || w["3"] != 33 {
+		t.Fatal("Weights should follow the load reports", w)
+	}
+
+	// Stale reports are ignored
+	s.registry.SetLoad("web1", msg.Load{CPUIdle: &busy, Reported: time.Now().Add(-2 * loadTimeout)})
+	s.registry.SetLoad("web2", msg.Load{CPUIdle: &idle, Reported: time.Now().Add(-2 * loadTimeout)})
+	w = s.weights(services)
+	if w["1"] != 33 || w["2"] != 33 || w["3"] != 33 {
+		t.Fatal("Stale load reports should be ignored", w)
+	}
+
+	// The zone does not depend on the load reports
+	s.registry.SetLoad("web1", msg.Load{CPUIdle: &busy, Reported: time.Now()})
+	w = equalWeights(services)
+	if w["1"] != 33 || w["2"] != 33 || w["3"] != 33 {
+		t.Fatal("Equal weights should ignore the load reports", w)
+	}
+}
+
+func TestHeadroom(t *testing.T) {
+	load, idle, free := 0.5, 0.8, 0.3
+	tests := []struct {
+		l msg.Load
+		h float64
+	}{
+		{msg.Load{}, 1},
+		{msg.Load{LoadAverage: &load}, 0.5},
+		{msg.Load{LoadAverage: &load, CPUIdle: &idle, MemoryFree: &free}, 0.3},
+	}
+	for _, tc := range tests {
+		if h := tc.l.Headroom(); h != tc.h {
+			t.Errorf("Headroom should be %f, got %f", tc.h, h)
+		}
+	}
+	over := 2.0
+	if h := (&msg.Load{LoadAverage: &over}).Headroom(); h != 0 {
+		t.Error("An overloaded host should have no headroom")
+	}
+}
+
+func TestTopology(t *testing.T) {
+	s := &Server{domain: "skydns.local", registry: registry.New(), loadTimeout: loadTimeout}
+	for i, region := range []string{"East", "Central", "West", "Asia", "Moon"} {
+		s.registry.Add(msg.Service{UUID: strconv.Itoa(i), Name: "TestService", Version: "1.0.0", Region: region, Host: "server" + strconv.Itoa(i), Environment: "Production", Port: 80, TTL: 30, Expires: getExpirationTime(30)})
+	}
+	q := dns.Question{Name: "east.*.testservice.production.skydns.local.", Qtype: dns.TypeSRV, Qclass: dns.ClassINET}
+	priorities := func() map[string]uint16 {
+		records, _, err := s.getSRVRecords(q, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := make(map[string]uint16)
+		for _, r := range records {
+			srv := r.(*dns.SRV)
+			p[srv.Target] = srv.Priority
+		}
+		return p
+	}
+
+	// Without a topology every other region has the same priority
+	p := priorities()
+	if p["server0."] != 10 || p["server1."] != 20 || p["server2."] != 20 || p["server3."] != 20 || p["server4."] != 20 {
+		t.Fatal("Without a topology all other regions should have priority 20", p)
+	}
+
+	topology := msg.Topology{Distances: map[string]map[string]uint32{
+		"east":    {"central": 10, "west": 30},
+		"Asia":    {"EAST": 30},
+		"central": {"west": 10},
+	}}
+	if err := topology.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s.registry.SetTopology(topology)
+	p = priorities()
+	if p["server0."] != 10 || p["server1."] != 20 || p["server2."] != 30 || p["server3."] != 30 || p["server4."] != 40 {
+		t.Fatal("Priorities should follow the distances", p)
+	}
+
+	// A preference list takes precedence over the distances
+	topology.Preferences = map[string][]string{"east": {"asia"}}
+	if err := topology.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s.registry.SetTopology(topology)
+	p = priorities()
+	if p["server3."] != 20 || p["server1."] != 30 || p["server2."] != 30 || p["server4."] != 30 {
+		t.Fatal("Priorities should follow the preferences", p)
+	}
+
+	invalid := msg.Topology{Preferences: map[string][]string{"east": {"west", "West"}}}
+	if err := invalid.Validate(); err != msg.ErrTopologyInvalid {
+		t.Fatal("A region listed twice should be invalid")
+	}
+}
+
 func newTestServer(leader, secret, nameserver string) *Server {
 	members := make([]string, 0)
 
@@ -0,0 +1,215 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/goraft/raft"
+	"github.com/gorilla/mux"
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns1/registry"
+)
+
+var (
+	ErrStubZoneInvalid   = errors.New("Stub zone must be a valid domain outside of the SkyDNS domain")
+	ErrNameserverInvalid = errors.New("Nameservers must be given as host or host:port")
+)
+
+// stubZones holds the stub zones given at startup and the forwarders for all
+// stub zones.
+type stubZones struct {
+	sync.RWMutex
+	static     map[string][]string   // nameservers by domain, given at startup
+	forwarders map[string]*forwarder // by domain, rebuilt when the stub zones change
+}
+
+func newStubZones() *stubZones {
+	return &stubZones{static: make(map[string][]string), forwarders: make(map[string]*forwarder)}
+}
+
+// SetStubZones forwards the queries for each domain, and the names below it,
+// to its own nameservers instead of the default ones. The stub zone with the
+// longest matching domain is used, stub zones added through the API take
+// precedence over these.
+func (s *Server) SetStubZones(zones map[string][]string) error {
+	for d, ns := range zones {
+		d, ns, err := s.checkStubZone(d, ns)
+		if err != nil {
+			return err
+		}
+		s.stubs.static[d] = ns
+	}
+	s.updateStubZones()
+	return nil
+}
+
+// updateStubZones rebuilds the forwarders of the stub zones, the ones given at
+// startup and the ones in the registry, after the stub zones changed. The
+// forwarders whose nameservers did not change are kept, so the health of
+// their nameservers is not forgotten.
+func (s *Server) updateStubZones() {
+	zones := s.registry.StubZones()
+
+	s.stubs.Lock()
+	defer s.stubs.Unlock()
+	for d, ns := range s.stubs.static {
+		if _, ok := zones[d]; !ok {
+			zones[d] = ns
+		}
+	}
+	forwarders := make(map[string]*forwarder, len(zones))
+	for d, ns := range zones {
+		f, ok := s.stubs.forwarders[d]
+		if !ok || !f.uses(ns) {
+			f = newForwarder(ns)
+			f.race, f.cache = s.forwarder.race, s.forwarder.cache
+		}
+		forwarders[d] = f
+	}
+	s.stubs.forwarders = forwarders
+}
+
+// checkStubZone checks stub zone domain and its nameservers and returns them
+// normalized: the domain lowercased and fully qualified and the nameservers
+// with a port.
+func (s *Server) checkStubZone(domain string, nameservers []string) (string, []string, error) {
+	domain = dns.Fqdn(strings.ToLower(domain))
+	if _, ok := dns.IsDomainName(domain); !ok || domain == "." || dns.IsSubDomain(dns.Fqdn(s.domain), domain) {
+		return "", nil, ErrStubZoneInvalid
+	}
+	if len(nameservers) == 0 {
+		return "", nil, ErrNameserverInvalid
+	}
+	ns := make([]string, 0, len(nameservers))
+	for _, n := range nameservers {
+		host, port, err := net.SplitHostPort(n)
+		if err != nil {
+			host, port = n, "53"
+		}
+		if host == "" || port == "" {
+			return "", nil, ErrNameserverInvalid
+		}
+		ns = append(ns, net.JoinHostPort(host, port))
+	}
+	return domain, ns, nil
+}
+
+// forwarderFor returns the forwarder for name: the one of the stub zone with
+// the longest domain that name falls in, or the default forwarder.
+func (s *Server) forwarderFor(name string) *forwarder {
+	name = dns.Fqdn(strings.ToLower(name))
+
+	s.stubs.RLock()
+	defer s.stubs.RUnlock()
+	for _, i := range dns.Split(name) {
+		if f, ok := s.stubs.forwarders[name[i:]]; ok {
+			return f
+		}
+	}
+	return s.forwarder
+}
+
+// uses returns true if f forwards to exactly the nameservers ns.
+func (f *forwarder) uses(ns []string) bool {
+	if len(ns) != len(f.upstreams) {
+		return false
+	}
+	for i, u := range f.upstreams {
+		if u.addr != ns[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Handle API requests that add or replace a stub zone.
+func (s *Server) setStubZoneHTTPHandler(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	var domain string
+	var ok bool
+
+	if domain, ok = vars["domain"]; !ok {
+		http.Error(w, "Domain required", http.StatusBadRequest)
+		return
+	}
+
+	var zone struct {
+		Nameservers []string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&zone); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	domain, ns, err := s.checkStubZone(domain, zone.Nameservers)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := s.raftServer.Do(NewSetStubZoneCommand(domain, ns)); err != nil {
+		switch err {
+		case raft.NotLeaderError:
+			s.redirectToLeader(w, req)
+		default:
+			log.Println("Error: ", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Handle API requests that remove a stub zone.
+func (s *Server) removeStubZoneHTTPHandler(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	var domain string
+	var ok bool
+
+	if domain, ok = vars["domain"]; !ok {
+		http.Error(w, "Domain required", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := s.raftServer.Do(NewRemoveStubZoneCommand(domain)); err != nil {
+		switch err {
+		case registry.ErrStubZoneNotExists:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case raft.NotLeaderError:
+			s.redirectToLeader(w, req)
+		default:
+			log.Println("Error: ", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Handle API requests for the stub zones, the ones given at startup are
+// included unless the API replaced them.
+func (s *Server) getStubZonesHTTPHandler(w http.ResponseWriter, req *http.Request) {
+	zones := s.registry.StubZones()
+	s.stubs.Lock()
+	for d, ns := range s.stubs.static {
+		if _, ok := zones[d]; !ok {
+			zones[d] = ns
+		}
+	}
+	s.stubs.Unlock()
+
+	if err := json.NewEncoder(w).Encode(zones); err != nil {
+		log.Println("Error: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// SetTLS enables DNS-over-TLS (RFC 7858) on addr, usually port 853, with the
+// certificate in pem and its private key in key. Queries over TLS are handled
+// exactly like the ones over UDP and TCP.
+func (s *Server) SetTLS(addr, pem, key string) {
+	s.dnsTLSAddr = addr
+	s.dnsTLSPem = pem
+	s.dnsTLSKey = key
+}
+
+// listenTLS returns the listener for DNS-over-TLS.
+func (s *Server) listenTLS() (net.Listener, error) {
+	cert, err := tls.LoadX509KeyPair(s.dnsTLSPem, s.dnsTLSKey)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	return tls.Listen("tcp", s.dnsTLSAddr, config)
+}
+
+// serveTLS serves DNS-over-TLS, it blocks.
+func (s *Server) serveTLS() {
+	l, err := s.listenTLS()
+	if err != nil {
+		log.Fatalf("Start tls listener on %s failed:%s", s.dnsTLSAddr, err.Error())
+	}
+	s.dnsTLSServer = &dns.Server{
+		Listener:     l,
+		Net:          "tcp",
+		Handler:      s.dnsHandler,
+		ReadTimeout:  s.readTimeout,
+		WriteTimeout: s.writeTimeout,
+		TsigSecret:   s.transferKeys,
+	}
+	log.Printf("Starting DNS-over-TLS server on %s", s.dnsTLSAddr)
+	if err := s.dnsTLSServer.ActivateAndServe(); err != nil {
+		log.Fatalf("Start tls listener on %s failed:%s", s.dnsTLSAddr, err.Error())
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/goraft/raft"
+	"github.com/skynetservices/skydns1/msg"
+)
+
+// Handle API requests that replace the region topology.
+func (s *Server) setTopologyHTTPHandler(w http.ResponseWriter, req *http.Request) {
+	var t msg.Topology
+	if err := json.NewDecoder(req.Body).Decode(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := t.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := s.raftServer.Do(NewSetTopologyCommand(t)); err != nil {
+		switch err {
+		case raft.NotLeaderError:
+			s.redirectToLeader(w, req)
+		default:
+			log.Println("Error: ", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// Handle API requests for the region topology.
+func (s *Server) getTopologyHTTPHandler(w http.ResponseWriter, req *http.Request) {
+	if err := json.NewEncoder(w).Encode(s.registry.Topology()); err != nil {
+		log.Println("Error: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
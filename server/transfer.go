@@ -0,0 +1,283 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns1/msg"
+)
+
+const (
+	transferChunk   = 200 // maximum number of records in a single zone transfer message
+	transferHistory = 16  // number of zones kept for incremental transfers
+	zoneTTL         = 60  // TTL of the service records in a transferred zone
+)
+
+// zoneHistory keeps the most recently transferred zones, so incremental
+// transfers can be answered with the difference.
+type zoneHistory struct {
+	sync.Mutex
+	serials []uint32 // oldest first
+	zones   map[uint32][]dns.RR
+}
+
+func newZoneHistory() *zoneHistory {
+	return &zoneHistory{zones: make(map[uint32][]dns.RR)}
+}
+
+func (z *zoneHistory) get(serial uint32) ([]dns.RR, bool) {
+	z.Lock()
+	defer z.Unlock()
+	zone, ok := z.zones[serial]
+	return zone, ok
+}
+
+func (z *zoneHistory) add(serial uint32, zone []dns.RR) {
+	z.Lock()
+	defer z.Unlock()
+	if _, ok := z.zones[serial]; ok {
+		return
+	}
+	if len(z.serials) == transferHistory {
+		delete(z.zones, z.serials[0])
+		z.serials = z.serials[1:]
+	}
+	z.serials = append(z.serials, serial)
+	z.zones[serial] = zone
+}
+
+// SetTransfer allows zone transfers (AXFR and IXFR) from the networks in nets
+// and with the TSIG keys in keys, which maps key names to base64 encoded
+// secrets. When both are given a transfer must satisfy both, when neither is
+// given zone transfers are refused.
+func (s *Server) SetTransfer(nets []*net.IPNet, keys map[string]string) {
+	s.transferNets = nets
+	s.transferKeys = keys
+}
+
+// transferAllowed returns true if the zone transfer request req from w is allowed.
+func (s *Server) transferAllowed(w dns.ResponseWriter, req *dns.Msg) bool {
+	if len(s.transferNets) == 0 && len(s.transferKeys) == 0 {
+		return false
+	}
+	if len(s.transferNets) > 0 {
+		var ip net.IP
+		switch a := w.RemoteAddr().(type) {
+		case *net.TCPAddr:
+			ip = a.IP
+		case *net.UDPAddr:
+			ip = a.IP
+		}
+		allowed := false
+		for _, n := range s.transferNets {
+			if n.Contains(ip) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	if len(s.transferKeys) > 0 {
+		t := req.IsTsig()
+		if t == nil || w.TsigStatus() != nil {
+			return false
+		}
+		if _, ok := s.transferKeys[t.Hdr.Name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// ServeDNSTransfer answers AXFR and IXFR requests for our domain.
+func (s *Server) ServeDNSTransfer(w dns.ResponseWriter, req *dns.Msg) {
+	q := req.Question[0]
+	q.Name = strings.ToLower(q.Name)
+	if !s.transferAllowed(w, req) {
+		log.Printf("Refused zone transfer of %q to %q", q.Name, w.RemoteAddr())
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeRefused)
+		w.WriteMsg(m)
+		return
+	}
+	_, tcp := w.RemoteAddr().(*net.TCPAddr)
+	if q.Name != dns.Fqdn(s.domain) || (!tcp && q.Qtype == dns.TypeAXFR) {
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeRefused)
+		w.WriteMsg(m)
+		return
+	}
+
+	soa := s.createSOA()[0].(*dns.SOA)
+	serial := soa.Serial
+
+	if q.Qtype == dns.TypeIXFR {
+		var client uint32
+		if len(req.Ns) > 0 {
+			if c, ok := req.Ns[0].(*dns.SOA); ok {
+				client = c.Serial
+			}
+		}
+		// The client is up to date or we are on UDP, where we only
+		// send our SOA, so the client will retry over TCP.
+		if client == serial || !tcp {
+			s.writeTransfer(w, req, []dns.RR{soa})
+			return
+		}
+		if old, ok := s.zones.get(client); ok {
+			zone := s.zone(serial)
+			deleted, added := zoneDiff(old, zone)
+			oldSOA := dns.Copy(soa).(*dns.SOA)
+			oldSOA.Serial = client
+
+			rrs := make([]dns.RR, 0, len(deleted)+len(added)+4)
+			rrs = append(rrs, soa, oldSOA)
+			rrs = append(rrs, deleted...)
+			rrs = append(rrs, soa)
+			rrs = append(rrs, added...)
+			rrs = append(rrs, soa)
+			log.Printf("Incremental zone transfer of %q from serial %d to %d to %q", q.Name, client, serial, w.RemoteAddr())
+			s.writeTransfer(w, req, rrs)
+			return
+		}
+		// Fall back to a full zone transfer
+	}
+
+	zone := s.zone(serial)
+	rrs := make([]dns.RR, 0, len(zone)+2)
+	rrs = append(rrs, soa)
+	rrs = append(rrs, zone...)
+	rrs = append(rrs, soa)
+	log.Printf("Zone transfer of %q with serial %d to %q", q.Name, serial, w.RemoteAddr())
+	s.writeTransfer(w, req, rrs)
+}
+
+// writeTransfer writes the records rrs in one or more messages, which are
+// signed if the request was.
+func (s *Server) writeTransfer(w dns.ResponseWriter, req *dns.Msg, rrs []dns.RR) {
+	tsig := req.IsTsig()
+	for len(rrs) > 0 {
+		n := transferChunk
+		if n > len(rrs) {
+			n = len(rrs)
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Authoritative = true
+		m.Answer = rrs[:n]
+		rrs = rrs[n:]
+		if tsig != nil {
+			m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+		}
+		if err := w.WriteMsg(m); err != nil {
+			log.Println("Error: zone transfer failed:", err)
+			return
+		}
+		w.TsigTimersOnly(true)
+	}
+}
+
+// zone returns all records of our domain with serial serial, except the
+// SOA. These are the NS record, the records for every service at every
+// level of its name and the records for the UUIDs of the services. Names
+// with wildcards are not included. The TTLs of the services count down to
+// their expiration, a secondary can not do that, so the service records get
+// zoneTTL. This keeps the zone of a serial the same, for IXFR.
+func (s *Server) zone(serial uint32) []dns.RR {
+	if zone, ok := s.zones.get(serial); ok {
+		return zone
+	}
+
+	dom := dns.Fqdn(s.domain)
+	zone := []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: dom, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600}, Ns: "master." + dom}}
+	if rrs, _, _, err := s.addressRecords(dns.Question{Name: "master." + dom, Qtype: dns.TypeA, Qclass: dns.ClassINET}, "", nil); err == nil {
+		zone = append(zone, rrs...)
+	}
+
+	services, _ := s.registry.Get("*")
+	names := make(map[string]bool)
+	for _, serv := range services {
+		for _, n := range zoneNames(serv) {
+			names[n+"."+dom] = true
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for n := range names {
+		sorted = append(sorted, n)
+	}
+	sort.Strings(sorted)
+
+	first := len(zone)
+	for _, n := range sorted {
+		for _, t := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			// Services with a hostname are left out, their addresses are
+			// not part of our zone.
+			if rrs, _, _, err := s.addressRecords(dns.Question{Name: n, Qtype: t, Qclass: dns.ClassINET}, "", nil); err == nil {
+				zone = append(zone, rrs...)
+			}
+		}
+		// Load reports do not change the serial, so the weights in the
+		// zone are divided equally.
+		if rrs, _, err := s.srvRecords(dns.Question{Name: n, Qtype: dns.TypeSRV, Qclass: dns.ClassINET}, "", nil, equalWeights); err == nil {
+			zone = append(zone, rrs...)
+		}
+		if rrs, err := s.getTXTRecords(dns.Question{Name: n, Qtype: dns.TypeTXT, Qclass: dns.ClassINET}); err == nil {
+			zone = append(zone, rrs...)
+		}
+	}
+
+	for _, r := range zone[first:] {
+		r.Header().Ttl = zoneTTL
+	}
+
+	// Only keep the zone if the registry did not change while we created it
+	if s.serial() == serial {
+		s.zones.add(serial, zone)
+	}
+	return zone
+}
+
+// zoneNames returns the names, without our domain, under which service serv
+// can be found: every level of uuid.host.region.version.name.environment and
+// the UUID itself.
+func zoneNames(serv msg.Service) []string {
+	labels := strings.Split(strings.ToLower(strings.Join([]string{serv.UUID, strings.Replace(serv.Host, ".", "-", -1), serv.Region, strings.Replace(serv.Version, ".", "-", -1), serv.Name, serv.Environment}, ".")), ".")
+	names := make([]string, 0, len(labels)+1)
+	for i := range labels {
+		names = append(names, strings.Join(labels[i:], "."))
+	}
+	return append(names, strings.ToLower(serv.UUID))
+}
+
+// zoneDiff returns the records that are in old but not in zone and the records
+// that are in zone but not in old.
+func zoneDiff(old, zone []dns.RR) (deleted, added []dns.RR) {
+	o := make(map[string]bool, len(old))
+	for _, r := range old {
+		o[r.String()] = true
+	}
+	n := make(map[string]bool, len(zone))
+	for _, r := range zone {
+		n[r.String()] = true
+		if !o[r.String()] {
+			added = append(added, r)
+		}
+	}
+	for _, r := range old {
+		if !n[r.String()] {
+			deleted = append(deleted, r)
+		}
+	}
+	return deleted, added
+}
@@ -0,0 +1,328 @@
+// Copyright (c) 2013 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/skynetservices/skydns1/msg"
+	"github.com/skynetservices/skydns1/registry"
+)
+
+const (
+	// Number of events kept for clients that resume a watch.
+	watchHistory = 1000
+	// Maximum time a long-poll watch waits for new events.
+	watchTimeout = 60 * time.Second
+)
+
+var errWatchCleared = errors.New("Events for the requested index have been cleared")
+
+// watcher keeps the most recent registry events and wakes up clients waiting
+// for new ones.
+type watcher struct {
+	sync.Mutex
+	events    []msg.Event   // the last watchHistory events, oldest first
+	cleared   uint64        // highest index that has been removed from events
+	recovered bool          // the registry was recovered from a snapshot, the next event sets cleared
+	notify    chan struct{} // closed (and replaced) when an event is published
+}
+
+func newWatcher() *watcher {
+	return &watcher{
+		events: make([]msg.Event, 0, 10),
+		notify: make(chan struct{}),
+	}
+}
+
+// publish adds an event and wakes up all waiting clients.
+func (w *watcher) publish(e msg.Event) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.recovered {
+		// The first event after the snapshot, all before it are lost
+		w.cleared = e.Index - 1
+		w.recovered = false
+	}
+	if len(w.events) == watchHistory {
+		w.cleared = w.events[0].Index
+		copy(w.events, w.events[1:])
+		w.events = w.events[:len(w.events)-1]
+	}
+	w.events = append(w.events, e)
+
+	close(w.notify)
+	w.notify = make(chan struct{})
+}
+
+// recover drops the events, the registry has been replaced by a snapshot. The
+// index of the snapshot is not known yet: until the next event every resumed
+// watch gets errWatchCleared.
+func (w *watcher) recover() {
+	w.Lock()
+	defer w.Unlock()
+	w.events = w.events[:0]
+	w.recovered = true
+}
+
+// reset drops the events, the registry has been replaced by the snapshot at
+// index.
+func (w *watcher) reset(index uint64) {
+	w.Lock()
+	defer w.Unlock()
+	w.events = w.events[:0]
+	w.cleared = index
+	w.recovered = false
+}
+
+// since returns the events with an index of at least index that match domain. An
+// index of 0 only returns new events. It also returns the index to continue
+// from and a channel that is closed when the next event is published. If the
+// events at index are no longer available errWatchCleared is returned.
+func (w *watcher) since(index uint64, domain string) ([]msg.Event, uint64, <-chan struct{}, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	next := w.cleared + 1
+	if len(w.events) > 0 {
+		next = w.events[len(w.events)-1].Index + 1
+	}
+	if index == 0 {
+		return nil, next, w.notify, nil
+	}
+	if index <= w.cleared || w.recovered {
+		return nil, 0, nil, errWatchCleared
+	}
+
+	var events []msg.Event
+	for _, e := range w.events {
+		if e.Index >= index && registry.Match(domain, e.Service) {
+			events = append(events, e)
+		}
+	}
+	if next < index {
+		next = index
+	}
+	return events, next, w.notify, nil
+}
+
+// Handle API watch requests. The query parameter is a domain pattern as used in
+// DNS queries, index is the first raft index the client is interested in. Clients
+// that accept text/event-stream get a stream of Server-Sent Events, all others
+// get a JSON list of events as soon as there is at least one.
+func (s *Server) watchHTTPHandler(w http.ResponseWriter, req *http.Request) {
+	var (
+		q     string
+		index uint64
+		err   error
+	)
+
+	if q = req.URL.Query().Get("query"); q == "" {
+		q = "*"
+	}
+	if i := req.URL.Query().Get("index"); i != "" {
+		if index, err = strconv.ParseUint(i, 10, 64); err != nil {
+			http.Error(w, "Invalid index", http.StatusBadRequest)
+			return
+		}
+	}
+
+	stream := req.Header.Get("Accept") == "text/event-stream"
+	if stream {
+		// Resuming event streams tell us the last event they have seen
+		if id := req.Header.Get("Last-Event-ID"); id != "" {
+			if index, err = strconv.ParseUint(id, 10, 64); err != nil {
+				http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+				return
+			}
+			index++
+		}
+	}
+
+	wc := s.newWatchConn(w)
+	defer wc.close()
+	if stream {
+		s.streamEvents(wc, q, index)
+		return
+	}
+
+	timeout := time.NewTimer(wc.timeout)
+	defer timeout.Stop()
+	for {
+		events, next, notify, err := s.watch.since(index, q)
+		if err != nil {
+			wc.respond(http.StatusGone, "text/plain; charset=utf-8", []byte(err.Error()+"\n"))
+			return
+		}
+		if len(events) > 0 {
+			b, err := json.Marshal(events)
+			if err != nil {
+				log.Println("Error: ", err)
+				wc.respond(http.StatusInternalServerError, "text/plain; charset=utf-8", []byte(err.Error()+"\n"))
+				return
+			}
+			wc.respond(http.StatusOK, "application/json", append(b, '\n'))
+			return
+		}
+		index = next
+
+		select {
+		case <-notify:
+		case <-timeout.C:
+			wc.respond(http.StatusOK, "application/json", []byte("[]"))
+			return
+		case <-wc.closed:
+			return
+		}
+	}
+}
+
+// streamEvents sends events as Server-Sent Events until the client goes away.
+func (s *Server) streamEvents(wc *watchConn, q string, index uint64) {
+	if !wc.start("text/event-stream") {
+		return
+	}
+	for {
+		events, next, notify, err := s.watch.since(index, q)
+		if err != nil {
+			fmt.Fprintf(wc.body, "event: error\ndata: %s\n\n", err.Error())
+			wc.flush()
+			return
+		}
+		for _, e := range events {
+			b, err := json.Marshal(e)
+			if err != nil {
+				log.Println("Error: ", err)
+				continue
+			}
+			fmt.Fprintf(wc.body, "id: %d\nevent: %s\ndata: %s\n\n", e.Index, e.Type, b)
+		}
+		if len(events) > 0 && !wc.flush() {
+			return
+		}
+		index = next
+
+		select {
+		case <-notify:
+		case <-wc.closed:
+			return
+		}
+	}
+}
+
+// watchConn is the connection of a watch. A watch stays open longer than the
+// write timeout of the HTTP server, so the connection is taken over from the
+// HTTP server and its deadlines are cleared. Connections that can not be taken
+// over are used as is, a long-poll then ends before the write timeout and an
+// event stream is cut off by it, the client resumes with Last-Event-ID.
+type watchConn struct {
+	w       http.ResponseWriter
+	conn    net.Conn          // nil when not taken over
+	buf     *bufio.ReadWriter // of conn
+	body    io.Writer
+	closed  <-chan bool   // closed when the client goes away
+	timeout time.Duration // maximum time a long-poll waits
+}
+
+func (s *Server) newWatchConn(w http.ResponseWriter) *watchConn {
+	wc := &watchConn{w: w, body: w, timeout: watchTimeout}
+	if hj, ok := w.(http.Hijacker); ok {
+		if conn, buf, err := hj.Hijack(); err == nil {
+			conn.SetDeadline(time.Time{})
+			closed := make(chan bool)
+			go func() {
+				// Reading only ends when the client or we close the connection
+				io.Copy(ioutil.Discard, buf)
+				close(closed)
+			}()
+			wc.conn, wc.buf, wc.body, wc.closed = conn, buf, buf, closed
+			return wc
+		}
+	}
+	if cn, ok := w.(http.CloseNotifier); ok {
+		wc.closed = cn.CloseNotify()
+	}
+	if s.writeTimeout > 0 && s.writeTimeout/2 < wc.timeout {
+		wc.timeout = s.writeTimeout / 2
+	}
+	return wc
+}
+
+// respond writes a complete response.
+func (wc *watchConn) respond(code int, contentType string, body []byte) {
+	if wc.conn == nil {
+		wc.w.Header().Set("Content-Type", contentType)
+		wc.w.WriteHeader(code)
+		wc.w.Write(body)
+		return
+	}
+	wc.write(code, http.Header{"Content-Type": {contentType}}, body, int64(len(body)))
+}
+
+// start writes the header of a response whose body lasts until the
+// connection is closed, it returns false if that is not possible.
+func (wc *watchConn) start(contentType string) bool {
+	if wc.conn == nil {
+		if _, ok := wc.w.(http.Flusher); !ok {
+			http.Error(wc.w, "Streaming not supported", http.StatusInternalServerError)
+			return false
+		}
+		wc.w.Header().Set("Content-Type", contentType)
+		wc.w.Header().Set("Cache-Control", "no-cache")
+		wc.w.WriteHeader(http.StatusOK)
+		return wc.flush()
+	}
+	return wc.write(http.StatusOK, http.Header{"Content-Type": {contentType}, "Cache-Control": {"no-cache"}}, nil, -1)
+}
+
+// write writes a response on a connection that was taken over, a length of
+// -1 leaves the body open until the connection is closed. It returns false if
+// that failed.
+func (wc *watchConn) write(code int, h http.Header, body []byte, length int64) bool {
+	resp := &http.Response{
+		StatusCode:    code,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		ContentLength: length,
+		Close:         true,
+	}
+	if body != nil {
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	if err := resp.Write(wc.buf); err != nil {
+		return false
+	}
+	return wc.flush()
+}
+
+// flush sends what has been written, it returns false if that failed.
+func (wc *watchConn) flush() bool {
+	if wc.conn == nil {
+		wc.w.(http.Flusher).Flush()
+		return true
+	}
+	return wc.buf.Flush() == nil
+}
+
+// close closes a connection that was taken over.
+func (wc *watchConn) close() {
+	if wc.conn != nil {
+		wc.conn.Close()
+	}
+}
@@ -15,12 +15,26 @@ import (
 )
 
 var (
-	ExpiredCount       metrics.Counter
-	RequestCount       metrics.Counter
-	AddServiceCount    metrics.Counter
-	UpdateTTLCount     metrics.Counter
-	GetServiceCount    metrics.Counter
-	RemoveServiceCount metrics.Counter
+	ExpiredCount        metrics.Counter
+	RequestCount        metrics.Counter
+	AddServiceCount     metrics.Counter
+	UpdateTTLCount      metrics.Counter
+	GetServiceCount     metrics.Counter
+	RemoveServiceCount  metrics.Counter
+	CheckFailedCount    metrics.Counter
+	CallbackCount       metrics.Counter
+	CallbackFailedCount metrics.Counter
+
+	ForwardCacheHitCount  metrics.Counter
+	ForwardCacheMissCount metrics.Counter
+	ForwardFailedCount    metrics.Counter
+
+	RateLimitDropCount metrics.Counter
+	RateLimitSlipCount metrics.Counter
+
+	SignatureCacheHitCount   metrics.Counter
+	SignatureCacheMissCount  metrics.Counter
+	SignatureCacheEvictCount metrics.Counter
 
 	metricsToStdErr             bool
 	graphiteServer, stathatUser string
@@ -55,6 +69,44 @@ func init() {
 
 	RemoveServiceCount = metrics.NewCounter()
 	metrics.Register("skydns-remove-service-requests", RemoveServiceCount)
+
+	CheckFailedCount = metrics.NewCounter()
+	metrics.Register("skydns-failed-health-checks", CheckFailedCount)
+
+	CallbackCount = metrics.NewCounter()
+	metrics.Register("skydns-callbacks", CallbackCount)
+
+	CallbackFailedCount = metrics.NewCounter()
+	metrics.Register("skydns-failed-callbacks", CallbackFailedCount)
+
+	ForwardCacheHitCount = metrics.NewCounter()
+	metrics.Register("skydns-forward-cache-hits", ForwardCacheHitCount)
+
+	ForwardCacheMissCount = metrics.NewCounter()
+	metrics.Register("skydns-forward-cache-misses", ForwardCacheMissCount)
+
+	ForwardFailedCount = metrics.NewCounter()
+	metrics.Register("skydns-failed-forwards", ForwardFailedCount)
+
+	RateLimitDropCount = metrics.NewCounter()
+	metrics.Register("skydns-rate-limit-drops", RateLimitDropCount)
+
+	RateLimitSlipCount = metrics.NewCounter()
+	metrics.Register("skydns-rate-limit-slips", RateLimitSlipCount)
+
+	SignatureCacheHitCount = metrics.NewCounter()
+	metrics.Register("skydns-signature-cache-hits", SignatureCacheHitCount)
+
+	SignatureCacheMissCount = metrics.NewCounter()
+	metrics.Register("skydns-signature-cache-misses", SignatureCacheMissCount)
+
+	SignatureCacheEvictCount = metrics.NewCounter()
+	metrics.Register("skydns-signature-cache-evictions", SignatureCacheEvictCount)
+}
+
+// UpstreamFailedCount returns the counter of failed forwards to nameserver addr.
+func UpstreamFailedCount(addr string) metrics.Counter {
+	return metrics.GetOrRegisterCounter("skydns-failed-forwards-"+addr, metrics.DefaultRegistry)
 }
 
 func Collect() {